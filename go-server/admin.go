@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"maps"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+var errCancelledByAdmin = errors.New("request cancelled by an administrator")
+
+// AdminMiddleware only lets through users with the admin role. It must run
+// after JWTMiddleware.
+func AdminMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if role, _ := c.Get("role").(string); role != roleAdmin {
+			return c.JSON(http.StatusForbidden, echo.Map{"error": "Admin role required"})
+		}
+		return next(c)
+	}
+}
+
+// Queue Manager Controls
+
+// Stats summarises the queue, the dispatcher and the backend.
+func (rqm *RequestQueueManager) Stats() map[string]any {
+	rqm.mu.Lock()
+	defer rqm.mu.Unlock()
+	return map[string]any{
+		"depth":             rqm.queue.Len(),
+		"depth_by_priority": rqm.queue.LenByPriority(),
+		"active":            rqm.activeQueries,
+		"active_by_user":    maps.Clone(rqm.activeByUser),
+		"concurrency_limit": rqm.limiter.Limit(),
+		"active_tokens":     rqm.activeTokens,
+		"token_budget":      inflightTokenBudget,
+		"avg_service_ms":    rqm.avgServiceTime.Milliseconds(),
+		"coalesced":         rqm.coalesced,
+		"paused":            rqm.paused,
+		"draining":          rqm.draining,
+		"backend":           rqm.backend.Status(),
+	}
+}
+
+// Cancel stops the queued or active request with the given id, reporting
+// whether there was one.
+func (rqm *RequestQueueManager) Cancel(id string) bool {
+	rqm.mu.Lock()
+	defer rqm.mu.Unlock()
+
+	var found *Request
+	rqm.queue.each(func(req *Request) {
+		if req.id == id {
+			found = req
+		}
+	})
+	for req := range rqm.active {
+		if req.id == id {
+			found = req
+		}
+	}
+	if found == nil {
+		return false
+	}
+	// Queued requests leave the queue through cancelQueued, active ones
+	// through the interactor noticing the cancelled context.
+	found.cancel(errCancelledByAdmin)
+	return true
+}
+
+// Pause stops dispatching. Queued requests stay queued and do not age while
+// paused: their expiry is put off by as long as the pause lasts. Active
+// requests run to completion.
+func (rqm *RequestQueueManager) Pause() {
+	rqm.mu.Lock()
+	defer rqm.mu.Unlock()
+	if rqm.paused {
+		return
+	}
+	rqm.paused = true
+	now := time.Now()
+	rqm.queue.each(func(req *Request) {
+		req.expiry.Stop()
+		req.expiryLeft = req.expiresAt.Sub(now)
+	})
+}
+
+func (rqm *RequestQueueManager) Resume() {
+	rqm.mu.Lock()
+	defer rqm.mu.Unlock()
+	if !rqm.paused {
+		return
+	}
+	rqm.paused = false
+	now := time.Now()
+	rqm.queue.each(func(req *Request) {
+		req.expiresAt = now.Add(req.expiryLeft)
+		req.expiry.Reset(req.expiryLeft)
+	})
+	rqm.cond.Broadcast()
+}
+
+// Handler Functions
+
+func ListRequestsHandler(c echo.Context) error {
+	queued, active := rqManager.Snapshot()
+	return c.JSON(http.StatusOK, echo.Map{
+		"queued": queued,
+		"active": active,
+	})
+}
+
+func QueueStatsHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, rqManager.Stats())
+}
+
+func CancelRequestHandler(c echo.Context) error {
+	id := c.Param("id")
+	if !rqManager.Cancel(id) {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "Request not found"})
+	}
+	log.Printf("[Admin] %s cancelled request %s", c.Get("username"), id)
+	return c.JSON(http.StatusOK, echo.Map{"message": "Request cancelled"})
+}
+
+func PauseDispatchHandler(c echo.Context) error {
+	rqManager.Pause()
+	log.Printf("[Admin] %s paused dispatching", c.Get("username"))
+	return c.JSON(http.StatusOK, echo.Map{"message": "Dispatching paused"})
+}
+
+func ResumeDispatchHandler(c echo.Context) error {
+	rqManager.Resume()
+	log.Printf("[Admin] %s resumed dispatching", c.Get("username"))
+	return c.JSON(http.StatusOK, echo.Map{"message": "Dispatching resumed"})
+}
+
+func AdminRouteController(e *echo.Echo) {
+	adminGroup := e.Group("/admin")
+
+	adminGroup.Use(JWTMiddleware, AdminMiddleware)
+	adminGroup.GET("/requests", ListRequestsHandler)
+	adminGroup.DELETE("/requests/:id", CancelRequestHandler)
+	adminGroup.GET("/stats", QueueStatsHandler)
+	adminGroup.POST("/dispatch/pause", PauseDispatchHandler)
+	adminGroup.POST("/dispatch/resume", ResumeDispatchHandler)
+}
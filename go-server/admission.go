@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+var (
+	maxQueueDepth     = envInt("LLM_MAX_QUEUE_DEPTH", 30)
+	maxPendingPerUser = envInt("LLM_MAX_PENDING_PER_USER", 3)
+)
+
+const minRetryAfter = time.Second
+
+// OverloadedError is returned by AddRequest when a request is refused rather
+// than queued. RetryAfter is a hint derived from recent throughput.
+type OverloadedError struct {
+	Reason     string
+	RetryAfter time.Duration
+}
+
+func (e *OverloadedError) Error() string {
+	return fmt.Sprintf("%s, retry after %d seconds", e.Reason, e.RetryAfterSeconds())
+}
+
+func (e *OverloadedError) RetryAfterSeconds() int {
+	return int(math.Ceil(e.RetryAfter.Seconds()))
+}
+
+// admit checks req against the queue limits. Must be called with rqm.mu held.
+func (rqm *RequestQueueManager) admit(req *Request) error {
+	if err := checkTokenBudget(req.tokens); err != nil {
+		return err
+	}
+
+	if rqm.queue.Len() >= maxQueueDepth {
+		overflow := rqm.queue.Len() - maxQueueDepth + 1
+		return &OverloadedError{
+			Reason:     "Server overloaded",
+			RetryAfter: rqm.retryAfter(rqm.estimateWait(overflow)),
+		}
+	}
+
+	if pending := rqm.queue.userLen(req.username); pending >= maxPendingPerUser {
+		// A user's requests drain at most maxActivePerUser at a time.
+		wait := time.Duration(0)
+		if rqm.avgServiceTime > 0 && maxActivePerUser > 0 {
+			overflow := pending - maxPendingPerUser + 1
+			wait = rqm.avgServiceTime * time.Duration(overflow) / time.Duration(maxActivePerUser)
+		}
+		return &OverloadedError{
+			Reason:     "Too many pending requests",
+			RetryAfter: rqm.retryAfter(wait),
+		}
+	}
+	return nil
+}
+
+// RetryAfter suggests when a caller refused for reasons outside the queue
+// might try again: about one generation from now.
+func (rqm *RequestQueueManager) RetryAfter() time.Duration {
+	rqm.mu.Lock()
+	defer rqm.mu.Unlock()
+	return rqm.retryAfter(rqm.avgServiceTime)
+}
+
+func (rqm *RequestQueueManager) retryAfter(estimate time.Duration) time.Duration {
+	// Without any completed requests to go on, one grace period is a fair guess.
+	if estimate == 0 {
+		return gracePeriod
+	}
+	return max(estimate, minRetryAfter)
+}
+
+// overloadedFrame is the WebSocket message for a refused request.
+func overloadedFrame(err *OverloadedError) map[string]any {
+	return map[string]any{
+		"error":       err.Error(),
+		"code":        "overloaded",
+		"retry_after": err.RetryAfterSeconds(),
+	}
+}
+
+// respondOverloaded answers a REST caller whose request was refused.
+func respondOverloaded(c echo.Context, err *OverloadedError) error {
+	c.Response().Header().Set("Retry-After", strconv.Itoa(err.RetryAfterSeconds()))
+	return c.JSON(http.StatusTooManyRequests, echo.Map{
+		"error":       err.Error(),
+		"code":        "overloaded",
+		"retry_after": err.RetryAfterSeconds(),
+	})
+}
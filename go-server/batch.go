@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Batches run a JSONL file of prompts through the queue at batch priority,
+// either as jobs on the server (POST /batches) or locally with the batch
+// subcommand (see batch_cli.go). Both read BatchLines and write BatchResults.
+
+var maxBatchLines = envInt("LLM_MAX_BATCH_LINES", 1000)
+
+const maxBatchLineSize = 64 * 1024
+
+// BatchLine is one line of a batch input file. ID defaults to the line number.
+// Batch results are only reported, never added to a chat.
+type BatchLine struct {
+	ID    string `json:"id,omitempty"`
+	Query string `json:"query"`
+	SamplingParams
+	Line int `json:"-"` // 1-based, counting blank lines
+}
+
+// BatchResult is one line of a batch output file.
+type BatchResult struct {
+	ID               string `json:"id"`
+	Line             int    `json:"line"`
+	Status           string `json:"status"` // completed, failed or cancelled
+	Response         string `json:"response,omitempty"`
+	FinishReason     string `json:"finish_reason,omitempty"`
+	PromptTokens     int    `json:"prompt_tokens,omitempty"`
+	CompletionTokens int    `json:"completion_tokens,omitempty"`
+	Error            string `json:"error,omitempty"`
+}
+
+// parseBatch reads and validates a batch input file. Blank lines are skipped
+// but still counted, so line numbers match the file.
+func parseBatch(r io.Reader) ([]BatchLine, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 4096), maxBatchLineSize)
+
+	var lines []BatchLine
+	seen := make(map[string]bool)
+	for n := 1; scanner.Scan(); n++ {
+		raw := bytes.TrimSpace(scanner.Bytes())
+		if len(raw) == 0 {
+			continue
+		}
+		if len(lines) == maxBatchLines {
+			return nil, fmt.Errorf("batch has more than %d lines", maxBatchLines)
+		}
+
+		var line BatchLine
+		if err := json.Unmarshal(raw, &line); err != nil {
+			return nil, fmt.Errorf("line %d: invalid JSON: %v", n, err)
+		}
+		if line.Query == "" {
+			return nil, fmt.Errorf("line %d: query is required", n)
+		}
+		params, err := line.SamplingParams.Resolve(samplingLimits)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		if err := checkTokenBudget(estimateTokens(line.Query, params)); err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		line.Line = n
+		if line.ID == "" {
+			line.ID = strconv.Itoa(n)
+		}
+		if seen[line.ID] {
+			return nil, fmt.Errorf("line %d: duplicate id %q", n, line.ID)
+		}
+		seen[line.ID] = true
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("batch is empty")
+	}
+	return lines, nil
+}
+
+func (job *Job) batchResult() BatchResult {
+	return BatchResult{
+		ID:               job.LineID,
+		Line:             job.Line,
+		Status:           job.Status,
+		Response:         job.Output,
+		FinishReason:     job.FinishReason,
+		PromptTokens:     job.PromptTokens,
+		CompletionTokens: job.CompletionTokens,
+		Error:            job.Error,
+	}
+}
+
+// Handler Functions
+
+func CreateBatchHandler(c echo.Context) error {
+	username := c.Get("username").(string)
+
+	lines, err := parseBatch(c.Request().Body)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+	}
+
+	batchID, err := jobQueue.EnqueueBatch(username, lines)
+	if err != nil {
+		var overloaded *OverloadedError
+		if errors.As(err, &overloaded) {
+			return respondOverloaded(c, overloaded)
+		}
+		log.Printf("[Batch] Failed to enqueue batch for %s: %v", username, err)
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to create batch"})
+	}
+	log.Printf("[Batch] Queued batch %s of %d lines for %s", batchID, len(lines), username)
+
+	return c.JSON(http.StatusAccepted, echo.Map{"id": batchID, "lines": len(lines)})
+}
+
+func GetBatchHandler(c echo.Context) error {
+	jobs, err := jobQueue.BatchJobs(c.Param("id"), c.Get("username").(string))
+	if err != nil {
+		log.Printf("[Batch] Error fetching batch %s: %v", c.Param("id"), err)
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Error retrieving batch"})
+	}
+	if len(jobs) == 0 {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "Batch not found"})
+	}
+
+	counts := make(map[string]int)
+	for _, job := range jobs {
+		counts[job.Status]++
+	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"id":     c.Param("id"),
+		"lines":  len(jobs),
+		"counts": counts,
+		"done":   counts[JobQueued]+counts[JobRunning] == 0,
+	})
+}
+
+// GetBatchOutputHandler returns the results of the finished lines as JSONL,
+// in input order. It can be fetched again while the batch is still running.
+func GetBatchOutputHandler(c echo.Context) error {
+	jobs, err := jobQueue.BatchJobs(c.Param("id"), c.Get("username").(string))
+	if err != nil {
+		log.Printf("[Batch] Error fetching batch %s: %v", c.Param("id"), err)
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Error retrieving batch"})
+	}
+	if len(jobs) == 0 {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "Batch not found"})
+	}
+
+	c.Response().Header().Set(echo.HeaderContentType, "application/x-ndjson")
+	c.Response().WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(c.Response())
+	for _, job := range jobs {
+		if job.Status == JobQueued || job.Status == JobRunning {
+			continue
+		}
+		if err := enc.Encode(job.batchResult()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Route Controller
+
+func BatchRouteController(e *echo.Echo) {
+	batchGroup := e.Group("/batches")
+
+	batchGroup.Use(JWTMiddleware, JobQueueMiddleware)
+	batchGroup.POST("", CreateBatchHandler)
+	batchGroup.GET("/:id", GetBatchHandler)
+	batchGroup.GET("/:id/output", GetBatchOutputHandler)
+}
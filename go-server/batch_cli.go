@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	pb "github.com/GeorgeMichailov/personalllmchat/go-server/model-service"
+)
+
+// batchUsername owns the requests of the batch subcommand, so the per-user
+// queue limits bound how much of the backend it takes.
+const batchUsername = "batch-cli"
+
+// runBatchCommand implements
+//
+//	go-server batch -in prompts.jsonl -out results.jsonl
+//
+// It sends each line through an in-process queue at batch priority and appends
+// a BatchResult per line to the output as soon as it finishes. Lines that
+// already completed in the output file are skipped, so an interrupted run is
+// resumed by running the same command again; failed lines are retried, their
+// old results replaced so the output keeps one result per id.
+func runBatchCommand(args []string) int {
+	fs := flag.NewFlagSet("batch", flag.ExitOnError)
+	inPath := fs.String("in", "", "JSONL file of prompts: {\"id\": ..., \"query\": ..., sampling parameters}")
+	outPath := fs.String("out", "", "JSONL file to append results to")
+	parallel := fs.Int("parallel", maxActivePerUser, "requests to keep in flight")
+	fs.Parse(args)
+	if *inPath == "" || *outPath == "" {
+		fs.Usage()
+		return 2
+	}
+
+	in, err := os.Open(*inPath)
+	if err != nil {
+		log.Printf("[Batch] %v", err)
+		return 1
+	}
+	lines, err := parseBatch(in)
+	in.Close()
+	if err != nil {
+		log.Printf("[Batch] %s: %v", *inPath, err)
+		return 1
+	}
+
+	completed, err := compactBatchOutput(*outPath)
+	if err != nil {
+		log.Printf("[Batch] %s: %v", *outPath, err)
+		return 1
+	}
+	out, err := os.OpenFile(*outPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		log.Printf("[Batch] %v", err)
+		return 1
+	}
+	defer out.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	startFakeModel(ctx)
+	rqManager.Start(ctx)
+
+	var pending []BatchLine
+	for _, line := range lines {
+		if !completed[line.ID] {
+			pending = append(pending, line)
+		}
+	}
+
+	todo := make(chan BatchLine)
+	go func() {
+		defer close(todo)
+		for _, line := range pending {
+			select {
+			case todo <- line:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var mu sync.Mutex
+	counts := make(map[string]int)
+	var wg sync.WaitGroup
+	for w := 0; w < max(*parallel, 1); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			enc := json.NewEncoder(out)
+			for line := range todo {
+				result, ok := runBatchLine(ctx, line)
+				if !ok {
+					return // interrupted; the line is retried next run
+				}
+				mu.Lock()
+				counts[result.Status]++
+				if err := enc.Encode(result); err != nil {
+					log.Printf("[Batch] Failed to write result for line %d: %v", line.Line, err)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	log.Printf("[Batch] %d lines: %d skipped, %d completed, %d failed",
+		len(lines), len(lines)-len(pending), counts[JobCompleted], counts[JobFailed])
+	if ctx.Err() != nil {
+		log.Printf("[Batch] Interrupted; run the same command again to resume")
+		return 1
+	}
+	if counts[JobFailed] > 0 {
+		return 1
+	}
+	return 0
+}
+
+// compactBatchOutput rewrites an existing output file to hold only the
+// results of completed lines, one per id, and returns those ids. The other
+// lines are run again and their new results appended.
+func compactBatchOutput(path string) (map[string]bool, error) {
+	completed := make(map[string]bool)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return completed, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var kept bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 4096), 1024*1024)
+	for scanner.Scan() {
+		var result BatchResult
+		// A line cut short by an interrupted write is simply run again.
+		if json.Unmarshal(scanner.Bytes(), &result) != nil || result.Status != JobCompleted || completed[result.ID] {
+			continue
+		}
+		completed[result.ID] = true
+		kept.Write(scanner.Bytes())
+		kept.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if kept.Len() == len(data) {
+		return completed, nil
+	}
+
+	// Write the compacted file next to the old one and swap them, so an
+	// interruption leaves one or the other intact.
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	if info, err := os.Stat(path); err == nil {
+		tmp.Chmod(info.Mode())
+	}
+	if _, err := tmp.Write(kept.Bytes()); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return nil, err
+	}
+	return completed, nil
+}
+
+// runBatchLine queues line until it runs, waiting out overload and expiry in
+// the queue. ok is false if ctx was cancelled first.
+func runBatchLine(ctx context.Context, line BatchLine) (result BatchResult, ok bool) {
+	result = BatchResult{ID: line.ID, Line: line.Line, Status: JobFailed}
+	params, err := line.SamplingParams.Resolve(samplingLimits)
+	if err != nil {
+		result.Error = err.Error()
+		return result, true
+	}
+
+	for ctx.Err() == nil {
+		reqCtx, cancel := context.WithCancelCause(ctx)
+		req := &Request{
+			query:      line.Query,
+			username:   batchUsername,
+			priority:   PriorityBatch,
+			ctx:        reqCtx,
+			cancel:     cancel,
+			responseCh: make(chan *pb.QueryResponse, 10),
+			createdAt:  time.Now(),
+			params:     params,
+		}
+		err := rqManager.AddRequest(req)
+		if err != nil {
+			cancel(nil)
+			var overloaded *OverloadedError
+			if !errors.As(err, &overloaded) {
+				result.Error = err.Error()
+				return result, true
+			}
+			sleepContext(ctx, overloaded.RetryAfter)
+			continue
+		}
+
+		result.Response = ""
+		done := collectBatchResult(req, &result)
+		rqManager.Finish()
+		cancel(nil)
+		if done {
+			return result, true
+		}
+		// Expired while queued, e.g. because the backend is not up yet.
+		sleepContext(ctx, time.Second)
+	}
+	return result, false
+}
+
+// collectBatchResult reads req's events into result, reporting false if the
+// request ended without an answer and should be queued again.
+func collectBatchResult(req *Request, result *BatchResult) bool {
+	for resp := range req.responseCh {
+		switch event := resp.Event.(type) {
+		case *pb.QueryResponse_Token:
+			result.Response += event.Token.Text
+		case *pb.QueryResponse_Summary:
+			result.Status = JobCompleted
+			result.FinishReason = event.Summary.FinishReason
+			result.PromptTokens = int(event.Summary.PromptTokens)
+			result.CompletionTokens = int(event.Summary.CompletionTokens)
+			return true
+		case *pb.QueryResponse_Error:
+			result.Error = fmt.Sprintf("%s: %s", event.Error.Code, event.Error.Message)
+			return true
+		}
+	}
+	return false
+}
+
+func sleepContext(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
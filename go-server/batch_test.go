@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Resuming keeps one completed result per id and drops failed results, whose
+// lines run again and append new ones.
+func TestCompactBatchOutput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.jsonl")
+	old := strings.Join([]string{
+		`{"id":"1","line":1,"status":"completed","response":"one"}`,
+		`{"id":"2","line":2,"status":"failed","error":"unavailable"}`,
+		`{"id":"3","line":3,"status":"completed","response":"three"}`,
+		`{"id":"2","line":2,"status":"failed","error":"timeout"}`,
+		`{"id":"1","line":1,"status":"completed","response":"one again"}`,
+		`{"id":"4","line":4,"status":"comp`, // cut short by an interruption
+	}, "\n")
+	if err := os.WriteFile(path, []byte(old), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	completed, err := compactBatchOutput(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(completed) != 2 || !completed["1"] || !completed["3"] {
+		t.Errorf("completed ids %v, want 1 and 3", completed)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"id":"1","line":1,"status":"completed","response":"one"}` + "\n" +
+		`{"id":"3","line":3,"status":"completed","response":"three"}` + "\n"
+	if string(data) != want {
+		t.Errorf("compacted output:\n%s\nwant:\n%s", data, want)
+	}
+}
+
+func TestCompactBatchOutputMissingFile(t *testing.T) {
+	completed, err := compactBatchOutput(filepath.Join(t.TempDir(), "none.jsonl"))
+	if err != nil || len(completed) != 0 {
+		t.Errorf("got %v, %v; want no completed ids and no error", completed, err)
+	}
+}
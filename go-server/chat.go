@@ -4,6 +4,7 @@ import (
 	"context"
 	"log"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/labstack/echo/v4"
@@ -18,13 +19,14 @@ type Chat struct {
 	ID            primitive.ObjectID  `json:"id,omitempty" bson:"_id,omitempty"`
 	OwnerUsername string              `json:"ownerid,omitempty" bson:"ownerid,omitempty"`
 	Title         string              `json:"title,omitempty" bson:"title,omitempty"`
-	Content       []map[string]string `json:"content,omitempty" bson:"content,omitempty"` // list of {user:"", model:""} interactions
+	Content       []map[string]string `json:"content,omitempty" bson:"content,omitempty"` // list of {user:"", model:""} interactions; answers cut short also have a finish_reason
 }
 
 type ChatInteraction struct {
-	ChatID    string
-	UserChat  string
-	ModelChat string
+	ChatID       string
+	UserChat     string
+	ModelChat    string
+	FinishReason string // only stored for answers cut short, e.g. wsproto.FinishStopped
 }
 
 // CRUD functions
@@ -86,6 +88,23 @@ func DeleteChat(c echo.Context) error {
 	return c.JSON(http.StatusOK, echo.Map{"message": "Chat deleted successfully"})
 }
 
+// ChatOwnedBy reports whether chatID names a chat of username.
+func ChatOwnedBy(chatID string, username string) (bool, error) {
+	id, err := primitive.ObjectIDFromHex(chatID)
+	if err != nil {
+		return false, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err = ChatCollection.FindOne(ctx, bson.M{"_id": id, "ownerid": username}).Err()
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	}
+	return err == nil, err
+}
+
 // Repository Functions
 
 func GetChatHandler(c echo.Context) error {
@@ -113,6 +132,61 @@ func ChatRouteController(e *echo.Echo) {
 
 // Utility Functions
 
+// The chat reads and writes made while answering a query. Tests replace them
+// to run without MongoDB.
+var (
+	chatOwnedBy    = ChatOwnedBy
+	createUserChat = CreateNewUserChat
+	deleteUserChat = DeleteUserChat
+	addInteraction = AddInteraction
+)
+
+// pendingInteractions tracks writes started by SaveInteraction so shutdown can
+// wait for them before disconnecting from Mongo. Once FlushInteractions has
+// begun no more writes are started, since a WaitGroup must not be added to
+// while it is being waited on.
+var (
+	pendingInteractions sync.WaitGroup
+	interactionsMu      sync.Mutex
+	interactionsFlushed bool // guarded by interactionsMu
+)
+
+// SaveInteraction stores interaction in the background. During shutdown, once
+// the pending writes are being flushed, the interaction is dropped instead.
+func SaveInteraction(interaction ChatInteraction) {
+	interactionsMu.Lock()
+	defer interactionsMu.Unlock()
+	if interactionsFlushed {
+		log.Printf("[Shutdown] Dropping interaction for chat %s saved after the flush", interaction.ChatID)
+		return
+	}
+	pendingInteractions.Add(1)
+	go func() {
+		defer pendingInteractions.Done()
+		addInteraction(interaction)
+	}()
+}
+
+// FlushInteractions stops further saves and waits until every background
+// write has finished or ctx is done.
+func FlushInteractions(ctx context.Context) error {
+	interactionsMu.Lock()
+	interactionsFlushed = true
+	interactionsMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		pendingInteractions.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func AddInteraction(interaction ChatInteraction) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -123,12 +197,16 @@ func AddInteraction(interaction ChatInteraction) {
 		return
 	}
 
+	entry := bson.M{
+		"user":  interaction.UserChat,
+		"model": interaction.ModelChat,
+	}
+	if interaction.FinishReason != "" {
+		entry["finish_reason"] = interaction.FinishReason
+	}
 	update := bson.M{
 		"$push": bson.M{
-			"content": bson.M{
-				"user":  interaction.UserChat,
-				"model": interaction.ModelChat,
-			},
+			"content": entry,
 		},
 	}
 
@@ -0,0 +1,62 @@
+// Command fakemodel serves the VLLMService gRPC API without a model, standing in
+// for vllm_server.py during development.
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/GeorgeMichailov/personalllmchat/go-server/fakemodel"
+)
+
+func main() {
+	var cfg fakemodel.Config
+	addr := flag.String("addr", ":50051", "address to listen on")
+	script := flag.String("script", "", "file with one token per line to stream instead of echoing the query")
+	flag.DurationVar(&cfg.TokenDelay, "delay", 50*time.Millisecond, "delay before each token")
+	flag.Float64Var(&cfg.FailRate, "fail-rate", 0, "probability that a query fails")
+	flag.IntVar(&cfg.FailAfter, "fail-after", 0, "tokens sent before an injected failure (at most the whole script)")
+	flag.Float64Var(&cfg.HangRate, "hang-rate", 0, "probability that a query hangs until cancelled")
+	flag.Parse()
+
+	if *script != "" {
+		tokens, err := readScript(*script)
+		if err != nil {
+			log.Fatal("Error reading script:", err)
+		}
+		cfg.Script = tokens
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	lis, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatal("Error listening:", err)
+	}
+	if err := fakemodel.Serve(ctx, lis, cfg); err != nil {
+		log.Fatal("Error serving:", err)
+	}
+}
+
+func readScript(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var tokens []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		tokens = append(tokens, scanner.Text())
+	}
+	return tokens, scanner.Err()
+}
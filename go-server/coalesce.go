@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	pb "github.com/GeorgeMichailov/personalllmchat/go-server/model-service"
+)
+
+// Identical deterministic requests share one generation. The first one to be
+// dispatched leads: its stream is recorded in a generation, and requests with
+// the same key that arrive while it runs, or are still queued when it is
+// dispatched, follow the recording instead of taking a slot of their own.
+// Every request keeps its own responseCh, state, chat persistence and
+// cancellation; the stream itself is only cancelled once all of them are gone.
+
+var coalesceRequests = !envBool("LLM_DISABLE_COALESCING")
+
+// coalesceKey returns the key under which req may share a generation, or "".
+func coalesceKey(query string, params *pb.SamplingParams) string {
+	if !coalesceRequests || !deterministic(params) {
+		return ""
+	}
+	return responseKey(query, params)
+}
+
+// generation records a leader's stream for its followers.
+type generation struct {
+	ctx    context.Context // the stream's context, see subscribe
+	cancel context.CancelFunc
+
+	mu          sync.Mutex
+	events      []*pb.QueryResponse
+	ended       bool
+	final       RequestState  // the leader's terminal state, once ended
+	changed     chan struct{} // closed and replaced whenever events or ended change
+	subscribers int
+}
+
+func newGeneration() *generation {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &generation{ctx: ctx, cancel: cancel, changed: make(chan struct{})}
+}
+
+// subscribe keeps the stream alive until req's context is done or the
+// returned function is called. It returns nil, without subscribing, if the
+// stream has already been cancelled because everyone else left.
+func (g *generation) subscribe(req *Request) (unsubscribe func()) {
+	g.mu.Lock()
+	if g.ctx.Err() != nil {
+		g.mu.Unlock()
+		return nil
+	}
+	g.subscribers++
+	g.mu.Unlock()
+
+	stop := context.AfterFunc(req.ctx, g.leave)
+	return func() {
+		if stop() {
+			g.leave()
+		}
+	}
+}
+
+func (g *generation) leave() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.subscribers--; g.subscribers == 0 {
+		g.cancel()
+	}
+}
+
+func (g *generation) publish(resp *pb.QueryResponse) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.events = append(g.events, resp)
+	close(g.changed)
+	g.changed = make(chan struct{})
+}
+
+func (g *generation) end(state RequestState) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.ended = true
+	g.final = state
+	close(g.changed)
+	g.cancel()
+}
+
+// follow relays the recording to req from the start, and then live, until
+// the leader's stream ends or req is cancelled. It returns req's final state.
+func (g *generation) follow(req *Request) RequestState {
+	for next := 0; ; {
+		g.mu.Lock()
+		if next < len(g.events) {
+			resp := g.events[next]
+			next++
+			g.mu.Unlock()
+
+			if _, ok := resp.Event.(*pb.QueryResponse_Token); ok {
+				now := time.Now()
+				if req.State() == StateDispatched {
+					req.transition(StateStreaming)
+					req.firstTokenAt = now
+				}
+				req.lastTokenAt = now
+				req.tokenCount.Add(1)
+			}
+			if !req.send(resp) {
+				return StateCancelled
+			}
+			continue
+		}
+		if g.ended {
+			final := g.final
+			g.mu.Unlock()
+			if req.ctx.Err() != nil {
+				return StateCancelled
+			}
+			return final
+		}
+		changed := g.changed
+		g.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-req.ctx.Done():
+			return StateCancelled
+		}
+	}
+}
+
+// leaderFor returns the request leading the generation req can share, if
+// any. A generation everyone has left is cancelled but stays listed until its
+// interactor returns; it cannot be shared. Must be called with rqm.mu held.
+func (rqm *RequestQueueManager) leaderFor(req *Request) *Request {
+	if req.coalesceKey == "" {
+		return nil
+	}
+	leader := rqm.generations[req.coalesceKey]
+	if leader == nil || leader.gen.ctx.Err() != nil {
+		return nil
+	}
+	return leader
+}
+
+// lead makes req, which is being dispatched, the leader of a new generation
+// and attaches any identical queued requests to it. Must be called with
+// rqm.mu held.
+func (rqm *RequestQueueManager) lead(req *Request) {
+	req.gen = newGeneration()
+	req.gen.subscribe(req)
+	rqm.generations[req.coalesceKey] = req
+
+	var identical []*Request
+	rqm.queue.each(func(queued *Request) {
+		if queued.coalesceKey == req.coalesceKey {
+			identical = append(identical, queued)
+		}
+	})
+	for _, follower := range identical {
+		if !rqm.follow(req, follower) {
+			if req.gen.ctx.Err() != nil {
+				break // req has already been cancelled; the rest stay queued
+			}
+			continue // follower has already ended; whoever ended it dequeues it
+		}
+		rqm.queue.remove(follower)
+		follower.expiry.Stop()
+		follower.stopCancel()
+	}
+	if len(identical) > 0 {
+		rqm.publishPositions()
+	}
+}
+
+// follow attaches req to leader's generation, reporting false if req could
+// not join it because the generation was cancelled or req has already ended.
+// Followers are listed with the active requests but take no slot. Must be
+// called with rqm.mu held.
+func (rqm *RequestQueueManager) follow(leader *Request, req *Request) bool {
+	gen := leader.gen
+	unsubscribe := gen.subscribe(req)
+	if unsubscribe == nil {
+		return false
+	}
+	if !req.transition(StateDispatched) {
+		unsubscribe()
+		return false
+	}
+	log.Printf("[Coalesce] Request %s from %s follows %s: %s", req.id, req.username, leader.id, req.query)
+	req.dispatchedAt = time.Now()
+	req.backend = leader.backend
+	req.publishStatus(QueueStatus{Status: "dispatched"})
+	rqm.active[req] = struct{}{}
+	rqm.coalesced++
+
+	go func() {
+		req.transition(gen.follow(req))
+		rqm.mu.Lock()
+		delete(rqm.active, req)
+		rqm.mu.Unlock()
+	}()
+	return true
+}
+
+// endGeneration forgets leader's generation so later requests start a new
+// one. Must be called with rqm.mu held.
+func (rqm *RequestQueueManager) endGeneration(leader *Request) {
+	if rqm.generations[leader.coalesceKey] == leader {
+		delete(rqm.generations, leader.coalesceKey)
+	}
+}
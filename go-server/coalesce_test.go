@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func newDeterministicRequest(username, query string) *Request {
+	req := newTestRequest(username, query)
+	req.params.Temperature = 0
+	return req
+}
+
+// A request identical to one whose generation has been cancelled, because
+// everyone sharing it left, must be queued rather than follow it and end
+// cancelled without an answer.
+func TestCancelledGenerationIsNotShared(t *testing.T) {
+	for _, cancelled := range []bool{false, true} {
+		rqm := createRequestQueueManager()
+
+		leader := newDeterministicRequest("alice", "what is 2+2")
+		leader.coalesceKey = coalesceKey(leader.query, leader.params)
+		leader.gen = newGeneration()
+		rqm.generations[leader.coalesceKey] = leader
+		if cancelled {
+			leader.gen.cancel()
+		}
+
+		req := newDeterministicRequest("bob", "what is 2+2")
+		if err := rqm.AddRequest(req); err != nil {
+			t.Fatal(err)
+		}
+
+		want := StateDispatched
+		if cancelled {
+			want = StateQueued
+		}
+		if got := req.State(); got != want {
+			t.Errorf("cancelled generation %v: request is %s, want %s", cancelled, got, want)
+		}
+		req.cancel(errClientGone)
+		rqm.Finish()
+	}
+}
+
+// A follower whose client goes away while it joins a generation ends cancelled
+// and lets go of the generation, which keeps running for the leader.
+func TestFollowerCancelledWhileJoining(t *testing.T) {
+	for _, ended := range []bool{false, true} {
+		rqm := createRequestQueueManager()
+		leader := newDeterministicRequest("alice", "what is 2+2")
+		leader.gen = newGeneration()
+		leader.gen.subscribe(leader)
+
+		req := newDeterministicRequest("bob", "what is 2+2")
+		req.cancel(errClientGone)
+		if ended { // as cancelQueued would have, had it got the lock first
+			req.transition(StateCancelled)
+		}
+
+		rqm.mu.Lock()
+		joined := rqm.follow(leader, req)
+		rqm.mu.Unlock()
+		if joined == ended {
+			t.Errorf("already ended %v: follow = %v", ended, joined)
+		}
+		drain(req)
+		waitFor(t, time.Second, "the follower to leave", func() bool {
+			rqm.mu.Lock()
+			defer rqm.mu.Unlock()
+			leader.gen.mu.Lock()
+			defer leader.gen.mu.Unlock()
+			return len(rqm.active) == 0 && leader.gen.subscribers == 1
+		})
+		if got := req.State(); got != StateCancelled {
+			t.Errorf("already ended %v: follower is %s, want %s", ended, got, StateCancelled)
+		}
+		if err := leader.gen.ctx.Err(); err != nil {
+			t.Errorf("already ended %v: the leader's generation was cancelled", ended)
+		}
+		leader.cancel(errClientGone)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+var (
+	minActiveQueries     = envInt("LLM_MIN_ACTIVE_QUERIES", 1)
+	maxActiveQueriesCap  = envInt("LLM_MAX_ACTIVE_QUERIES", 16)
+	initialActiveQueries = envInt("LLM_INITIAL_ACTIVE_QUERIES", 5)
+	targetTTFT           = time.Duration(envInt("LLM_TARGET_TTFT_MS", 2000)) * time.Millisecond
+	targetInterToken     = time.Duration(envInt("LLM_TARGET_ITL_MS", 100)) * time.Millisecond
+)
+
+const (
+	limitBackoffRatio = 0.75
+	limitCooldown     = 2 * time.Second // ignore further bad samples right after a decrease
+)
+
+// concurrencyLimiter adjusts how many generations may run at once using AIMD:
+// while finished requests meet the latency targets the limit grows by about
+// one per limit's worth of requests, and when they miss it is cut by
+// limitBackoffRatio. It is guarded by RequestQueueManager.mu.
+type concurrencyLimiter struct {
+	limit        float64
+	min, max     int
+	lastDecrease time.Time
+}
+
+func newConcurrencyLimiter() *concurrencyLimiter {
+	floor := max(minActiveQueries, 1)
+	ceiling := max(maxActiveQueriesCap, floor)
+	return &concurrencyLimiter{
+		limit: float64(min(max(initialActiveQueries, floor), ceiling)),
+		min:   floor,
+		max:   ceiling,
+	}
+}
+
+func (cl *concurrencyLimiter) Limit() int {
+	return int(cl.limit)
+}
+
+// observe feeds one finished request into the controller. inflight is how many
+// requests were running when it finished; the limit is only raised when it is
+// actually being used, so an idle server does not drift to the ceiling.
+func (cl *concurrencyLimiter) observe(ttft, interToken time.Duration, failed bool, inflight int) {
+	prev := cl.Limit()
+
+	if failed || ttft > targetTTFT || interToken > targetInterToken {
+		if time.Since(cl.lastDecrease) < limitCooldown {
+			return
+		}
+		cl.limit = max(cl.limit*limitBackoffRatio, float64(cl.min))
+		cl.lastDecrease = time.Now()
+	} else if inflight >= prev-1 {
+		cl.limit = min(cl.limit+1/cl.limit, float64(cl.max))
+	}
+
+	if next := cl.Limit(); next != prev {
+		log.Printf("[Concurrency] Limit %d -> %d (ttft %v, inter-token %v, failed %v)", prev, next, ttft, interToken, failed)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// withLimits sets LLM_MIN_ACTIVE_QUERIES, LLM_INITIAL_ACTIVE_QUERIES and
+// LLM_MAX_ACTIVE_QUERIES until the test ends.
+func withLimits(t *testing.T, floor, initial, ceiling int) {
+	prevMin, prevInitial, prevMax := minActiveQueries, initialActiveQueries, maxActiveQueriesCap
+	minActiveQueries, initialActiveQueries, maxActiveQueriesCap = floor, initial, ceiling
+	t.Cleanup(func() {
+		minActiveQueries, initialActiveQueries, maxActiveQueriesCap = prevMin, prevInitial, prevMax
+	})
+}
+
+func TestConcurrencyLimiterBounds(t *testing.T) {
+	tests := []struct {
+		name                    string
+		floor, initial, ceiling int
+		want                    int
+	}{
+		{"initial", 1, 5, 16, 5},
+		{"initial below the minimum", 3, 1, 16, 3},
+		{"initial above the maximum", 1, 20, 16, 16},
+		{"maximum below the minimum", 4, 5, 2, 4},
+		{"minimum below one", 0, 0, 16, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withLimits(t, tt.floor, tt.initial, tt.ceiling)
+			if got := newConcurrencyLimiter().Limit(); got != tt.want {
+				t.Errorf("Limit() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConcurrencyLimiterObserve(t *testing.T) {
+	defer func(ttft, itl time.Duration) { targetTTFT, targetInterToken = ttft, itl }(targetTTFT, targetInterToken)
+	targetTTFT, targetInterToken = time.Second, 100*time.Millisecond
+
+	type sample struct {
+		ttft, interToken time.Duration
+		failed           bool
+		inflight         int
+	}
+	good := func(inflight int) sample {
+		return sample{500 * time.Millisecond, 50 * time.Millisecond, false, inflight}
+	}
+	slowTTFT := sample{2 * time.Second, 50 * time.Millisecond, false, 8}
+	slowITL := sample{500 * time.Millisecond, 200 * time.Millisecond, false, 8}
+	failed := sample{500 * time.Millisecond, 50 * time.Millisecond, true, 8}
+
+	tests := []struct {
+		name                    string
+		floor, initial, ceiling int
+		samples                 []sample
+		want                    int
+	}{
+		{"grows by about one per limit's worth of requests", 1, 4, 16, slices.Repeat([]sample{good(4)}, 5), 5},
+		{"does not grow before then", 1, 4, 16, slices.Repeat([]sample{good(4)}, 4), 4},
+		{"does not grow while idle", 1, 4, 16, []sample{good(0), good(1), good(2), good(0), good(1)}, 4},
+		{"cut on a slow first token", 1, 8, 16, []sample{slowTTFT}, 6},
+		{"cut on slow tokens", 1, 8, 16, []sample{slowITL}, 6},
+		{"cut on a failure", 1, 8, 16, []sample{failed}, 6},
+		{"cut once per cooldown", 1, 8, 16, []sample{slowTTFT, slowITL, failed}, 6},
+		{"held at the minimum", 4, 5, 16, []sample{slowTTFT}, 4},
+		{"held at the maximum", 1, 16, 16, slices.Repeat([]sample{good(16)}, 40), 16},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withLimits(t, tt.floor, tt.initial, tt.ceiling)
+			cl := newConcurrencyLimiter()
+			for _, s := range tt.samples {
+				cl.observe(s.ttft, s.interToken, s.failed, s.inflight)
+			}
+			if got := cl.Limit(); got != tt.want {
+				t.Errorf("Limit() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// After the cooldown a further breach cuts the limit again.
+func TestConcurrencyLimiterCooldown(t *testing.T) {
+	defer func(ttft time.Duration) { targetTTFT = ttft }(targetTTFT)
+	targetTTFT = time.Second
+	withLimits(t, 1, 16, 16)
+
+	cl := newConcurrencyLimiter()
+	cl.observe(2*time.Second, 0, false, 16)
+	cl.lastDecrease = time.Now().Add(-limitCooldown)
+	cl.observe(2*time.Second, 0, false, 16)
+	if got := cl.Limit(); got != 9 { // 16 * 0.75 * 0.75
+		t.Errorf("Limit() = %d after two breaches a cooldown apart, want 9", got)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+)
+
+// Environment overrides for server settings. Unset or malformed variables
+// fall back to the given default.
+
+func envString(key string, def string) string {
+	if v, ok := os.LookupEnv(key); ok && v != "" {
+		return v
+	}
+	return def
+}
+
+func envBool(key string) bool {
+	v, _ := strconv.ParseBool(os.Getenv(key))
+	return v
+}
+
+func envInt(key string, def int) int {
+	raw, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+	v, err := strconv.Atoi(raw)
+	if err != nil {
+		log.Printf("[Config] Ignoring invalid %s=%q: %v", key, raw, err)
+		return def
+	}
+	return v
+}
+
+func envFloat(key string, def float64) float64 {
+	raw, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+	v, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		log.Printf("[Config] Ignoring invalid %s=%q: %v", key, raw, err)
+		return def
+	}
+	return v
+}
@@ -0,0 +1,108 @@
+package main
+
+// fairQueue holds one FIFO per user and hands requests out round-robin across
+// users, so a user with many queued requests cannot starve everyone else.
+// It is not safe for concurrent use; RequestQueueManager guards it with mu.
+type fairQueue struct {
+	users map[string][]*Request
+	ring  []string // users with queued requests, in round-robin order
+	next  int      // index in ring of the user to serve next
+	size  int
+}
+
+func newFairQueue() *fairQueue {
+	return &fairQueue{users: make(map[string][]*Request)}
+}
+
+func (fq *fairQueue) Len() int {
+	return fq.size
+}
+
+// clone returns a copy of fq that can be popped without changing fq.
+func (fq *fairQueue) clone() *fairQueue {
+	users := make(map[string][]*Request, len(fq.users))
+	for username, pending := range fq.users {
+		users[username] = pending // pop only reslices, it never writes
+	}
+	return &fairQueue{
+		users: users,
+		ring:  append([]string(nil), fq.ring...),
+		next:  fq.next,
+		size:  fq.size,
+	}
+}
+
+// each calls fn for every queued request, user by user in ring order.
+func (fq *fairQueue) each(fn func(*Request)) {
+	for _, username := range fq.ring {
+		for _, req := range fq.users[username] {
+			fn(req)
+		}
+	}
+}
+
+func (fq *fairQueue) push(req *Request) {
+	pending, ok := fq.users[req.username]
+	if !ok {
+		fq.ring = append(fq.ring, req.username)
+	}
+	fq.users[req.username] = append(pending, req)
+	fq.size++
+}
+
+// pop removes and returns the oldest request of the next user in round-robin
+// order for which eligible returns true, or nil if there is none. A user's
+// requests are only ever considered oldest first.
+func (fq *fairQueue) pop(eligible func(*Request) bool) *Request {
+	for i := 0; i < len(fq.ring); i++ {
+		idx := (fq.next + i) % len(fq.ring)
+		username := fq.ring[idx]
+		pending := fq.users[username]
+		req := pending[0]
+		if !eligible(req) {
+			continue
+		}
+
+		fq.users[username] = pending[1:]
+		fq.size--
+		fq.next = idx + 1
+		if len(pending) == 1 {
+			fq.dropUser(idx)
+		}
+		return req
+	}
+	return nil
+}
+
+// remove takes req out of the queue, reporting whether it was queued.
+func (fq *fairQueue) remove(req *Request) bool {
+	pending := fq.users[req.username]
+	for i, queued := range pending {
+		if queued != req {
+			continue
+		}
+		fq.users[req.username] = append(pending[:i], pending[i+1:]...)
+		fq.size--
+		if len(pending) == 1 {
+			for idx, username := range fq.ring {
+				if username == req.username {
+					fq.dropUser(idx)
+					break
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func (fq *fairQueue) dropUser(idx int) {
+	delete(fq.users, fq.ring[idx])
+	fq.ring = append(fq.ring[:idx], fq.ring[idx+1:]...)
+	if fq.next > idx {
+		fq.next--
+	}
+	if fq.next >= len(fq.ring) {
+		fq.next = 0
+	}
+}
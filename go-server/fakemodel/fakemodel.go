@@ -0,0 +1,188 @@
+// Package fakemodel implements the VLLMService gRPC API without a model so the
+// Go server can be run and exercised without a GPU.
+package fakemodel
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/GeorgeMichailov/personalllmchat/go-server/model-service"
+
+	"google.golang.org/grpc"
+)
+
+type Config struct {
+	// Script is streamed token by token for every query. When empty the
+	// query itself is echoed back word by word.
+	Script     []string
+	TokenDelay time.Duration
+
+	// FailRate is the probability that a query ends with an error event
+	// after FailAfter tokens, or after its last token if it has fewer.
+	FailRate  float64
+	FailAfter int
+
+	// HangRate is the probability that a query never produces a token and
+	// only returns once the caller cancels it.
+	HangRate float64
+}
+
+type Server struct {
+	pb.UnimplementedVLLMServiceServer
+	cfg Config
+
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+func NewServer(cfg Config) *Server {
+	return &Server{
+		cfg: cfg,
+		rng: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (s *Server) roll(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rng.Float64() < p
+}
+
+func (s *Server) Query(req *pb.QueryRequest, stream pb.VLLMService_QueryServer) error {
+	ctx := stream.Context()
+	started := time.Now()
+	log.Printf("[Fake Model] Received query: %s", req.Query)
+
+	if s.roll(s.cfg.HangRate) {
+		log.Printf("[Fake Model] Hanging on query: %s", req.Query)
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	fail := s.roll(s.cfg.FailRate)
+
+	tokens := s.cfg.Script
+	if len(tokens) == 0 {
+		tokens = echoTokens(req.Query)
+	}
+
+	maxTokens := len(tokens)
+	if req.Params != nil && req.Params.MaxTokens > 0 && int(req.Params.MaxTokens) < maxTokens {
+		maxTokens = int(req.Params.MaxTokens)
+	}
+
+	finishReason := "stop"
+	sent := 0
+	for _, token := range tokens {
+		if fail && sent >= s.cfg.FailAfter {
+			break
+		}
+		if sent == maxTokens {
+			finishReason = "length"
+			break
+		}
+		if hitsStop(token, req.Params) {
+			break
+		}
+
+		if err := sleep(ctx, s.cfg.TokenDelay); err != nil {
+			log.Printf("[Fake Model] Query cancelled after %d tokens: %s", sent, req.Query)
+			return err
+		}
+		if err := stream.Send(&pb.QueryResponse{Event: &pb.QueryResponse_Token{
+			Token: &pb.TokenDelta{Text: token},
+		}}); err != nil {
+			return err
+		}
+		sent++
+	}
+
+	if fail {
+		log.Printf("[Fake Model] Injecting failure after %d tokens for query: %s", sent, req.Query)
+		return stream.Send(&pb.QueryResponse{Event: &pb.QueryResponse_Error{
+			Error: &pb.QueryError{Code: "internal", Message: "injected failure"},
+		}})
+	}
+
+	log.Printf("[Fake Model] Completed query (%d tokens): %s", sent, req.Query)
+	return stream.Send(&pb.QueryResponse{Event: &pb.QueryResponse_Summary{
+		Summary: &pb.QuerySummary{
+			FinishReason:     finishReason,
+			PromptTokens:     int32(len(strings.Fields(req.Query))),
+			CompletionTokens: int32(sent),
+			LatencyMs:        time.Since(started).Milliseconds(),
+		},
+	}})
+}
+
+// echoTokens splits the query into words, keeping the separating space on
+// every token after the first so the concatenation matches the input.
+func echoTokens(query string) []string {
+	words := strings.Fields(query)
+	for i := 1; i < len(words); i++ {
+		words[i] = " " + words[i]
+	}
+	return words
+}
+
+func hitsStop(token string, params *pb.SamplingParams) bool {
+	if params == nil {
+		return false
+	}
+	for _, stop := range params.Stop {
+		if strings.Contains(token, stop) {
+			return true
+		}
+	}
+	return false
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Serve runs a fake model service on lis until ctx is cancelled.
+func Serve(ctx context.Context, lis net.Listener, cfg Config) error {
+	srv := grpc.NewServer()
+	pb.RegisterVLLMServiceServer(srv, NewServer(cfg))
+
+	go func() {
+		<-ctx.Done()
+		srv.Stop()
+	}()
+
+	log.Printf("[Fake Model] Serving on %s", lis.Addr())
+	return srv.Serve(lis)
+}
+
+// Start listens on addr (":0" picks a free port) and serves in the background.
+// It returns the address actually bound, for in-process use.
+func Start(ctx context.Context, addr string, cfg Config) (string, error) {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	go func() {
+		if err := Serve(ctx, lis, cfg); err != nil {
+			log.Printf("[Fake Model] Server stopped: %v", err)
+		}
+	}()
+	return lis.Addr().String(), nil
+}
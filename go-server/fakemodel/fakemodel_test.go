@@ -0,0 +1,80 @@
+package fakemodel
+
+import (
+	"context"
+	"testing"
+
+	pb "github.com/GeorgeMichailov/personalllmchat/go-server/model-service"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func query(t *testing.T, cfg Config, q string) (tokens int, last *pb.QueryResponse) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	addr, err := Start(ctx, "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	stream, err := pb.NewVLLMServiceClient(conn).Query(ctx, &pb.QueryRequest{Query: q})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("stream ended without a summary or error: %v", err)
+		}
+		if _, ok := resp.Event.(*pb.QueryResponse_Token); !ok {
+			return tokens, resp
+		}
+		tokens++
+	}
+}
+
+func TestFailAfter(t *testing.T) {
+	tests := []struct {
+		name       string
+		script     []string
+		failAfter  int
+		wantTokens int
+	}{
+		{"within the script", []string{"a", "b", "c", "d"}, 2, 2},
+		{"past the end of the script", []string{"a", "b"}, 10, 2},
+		{"before the first token", []string{"a", "b"}, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens, last := query(t, Config{Script: tt.script, FailRate: 1, FailAfter: tt.failAfter}, "q")
+			if tokens != tt.wantTokens {
+				t.Errorf("got %d tokens before the failure, want %d", tokens, tt.wantTokens)
+			}
+			if _, ok := last.Event.(*pb.QueryResponse_Error); !ok {
+				t.Errorf("query ended with %T, want an error event", last.Event)
+			}
+		})
+	}
+}
+
+func TestEcho(t *testing.T) {
+	tokens, last := query(t, Config{}, "hello there world")
+	if tokens != 3 {
+		t.Errorf("got %d tokens, want 3", tokens)
+	}
+	summary, ok := last.Event.(*pb.QueryResponse_Summary)
+	if !ok {
+		t.Fatalf("query ended with %T, want a summary", last.Event)
+	}
+	if summary.Summary.CompletionTokens != 3 || summary.Summary.FinishReason != "stop" {
+		t.Errorf("got summary %v", summary.Summary)
+	}
+}
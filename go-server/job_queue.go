@@ -0,0 +1,553 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	pb "github.com/GeorgeMichailov/personalllmchat/go-server/model-service"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Asynchronous requests are stored in Mongo so they survive a restart. Any
+// instance may lease a queued job; the lease is renewed while the job runs, so
+// a job whose instance died is picked up again once its lease expires.
+
+var (
+	jobQueueEnabled   = envBool("LLM_JOB_QUEUE")
+	jobWorkers        = envInt("LLM_JOB_WORKERS", 2)
+	maxJobsPerUser    = envInt("LLM_MAX_JOBS_PER_USER", 20)   // queued or running
+	maxBatchesPerUser = envInt("LLM_MAX_BATCHES_PER_USER", 2) // with lines queued or running
+
+	// How long a job may wait in the request queue per attempt. Nobody is
+	// watching it, so it may wait far longer than an interactive request.
+	jobQueueWait = time.Duration(envInt("LLM_JOB_QUEUE_WAIT_S", 600)) * time.Second
+)
+
+const (
+	jobLeaseTTL     = 30 * time.Second
+	jobHeartbeat    = 2 * time.Second // renews the lease and saves partial output for polling
+	jobPollInterval = 2 * time.Second
+	jobMaxAttempts  = 3
+)
+
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobCompleted = "completed"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+// Job Model
+
+type Job struct {
+	ID               primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Owner            string             `json:"owner" bson:"owner"`
+	ChatID           string             `json:"chatid,omitempty" bson:"chatid,omitempty"` // result is added to this chat
+	Query            string             `json:"query" bson:"query"`
+	Params           SamplingParams     `json:"params" bson:"params"`
+	Priority         Priority           `json:"priority" bson:"priority"`
+	Status           string             `json:"status" bson:"status"`
+	Output           string             `json:"output,omitempty" bson:"output,omitempty"`
+	FinishReason     string             `json:"finish_reason,omitempty" bson:"finish_reason,omitempty"`
+	Tokens           int                `json:"tokens" bson:"tokens"` // streamed so far
+	PromptTokens     int                `json:"prompt_tokens,omitempty" bson:"prompt_tokens,omitempty"`
+	CompletionTokens int                `json:"completion_tokens,omitempty" bson:"completion_tokens,omitempty"`
+	Error            string             `json:"error,omitempty" bson:"error,omitempty"`
+	Attempts         int                `json:"attempts" bson:"attempts"`
+	BatchID          string             `json:"batch_id,omitempty" bson:"batch_id,omitempty"`
+	Line             int                `json:"line,omitempty" bson:"line,omitempty"`       // 1-based line in the batch file
+	LineID           string             `json:"line_id,omitempty" bson:"line_id,omitempty"` // caller's id for the line
+	LeaseOwner       string             `json:"-" bson:"lease_owner,omitempty"`
+	LeaseExpires     time.Time          `json:"-" bson:"lease_expires,omitempty"`
+	CreatedAt        time.Time          `json:"created_at" bson:"created_at"`
+	UpdatedAt        time.Time          `json:"updated_at" bson:"updated_at"`
+}
+
+// Causes for stopping a running job: its lease was lost (or it was cancelled
+// on another instance), or its owner cancelled it here.
+var (
+	errJobLost      = errors.New("job lease lost")
+	errJobCancelled = errors.New("job cancelled")
+)
+
+type JobQueue struct {
+	collection *mongo.Collection
+	owner      string        // identifies this instance's leases
+	wake       chan struct{} // lets Enqueue skip the poll delay on this instance
+
+	mu      sync.Mutex
+	running map[primitive.ObjectID]context.CancelCauseFunc // jobs running on this instance
+}
+
+// jobQueue is nil unless LLM_JOB_QUEUE is set.
+var jobQueue *JobQueue
+
+func createJobQueue(collection *mongo.Collection) *JobQueue {
+	return &JobQueue{
+		collection: collection,
+		owner:      primitive.NewObjectID().Hex(),
+		wake:       make(chan struct{}, 1),
+		running:    make(map[primitive.ObjectID]context.CancelCauseFunc),
+	}
+}
+
+// CRUD functions
+
+// CheckAdmission reports the error Enqueue would refuse a job of owner with if
+// it were enqueued now, without enqueueing it. Enqueue still has the final say.
+func (jq *JobQueue) CheckAdmission(owner string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	pending, err := jq.collection.CountDocuments(ctx, bson.M{
+		"owner":    owner,
+		"status":   bson.M{"$in": bson.A{JobQueued, JobRunning}},
+		"batch_id": bson.M{"$exists": false}, // batches are limited by EnqueueBatch
+	})
+	if err != nil {
+		return err
+	}
+	if pending >= int64(maxJobsPerUser) {
+		return &OverloadedError{
+			Reason:     "Too many unfinished jobs",
+			RetryAfter: rqManager.RetryAfter(),
+		}
+	}
+	return nil
+}
+
+// Enqueue stores job as queued and fills in its id. It returns an
+// *OverloadedError if the owner already has maxJobsPerUser unfinished jobs.
+func (jq *JobQueue) Enqueue(job *Job) error {
+	if err := jq.CheckAdmission(job.Owner); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	job.ID = primitive.NewObjectID()
+	job.Status = JobQueued
+	job.CreatedAt = now
+	job.UpdatedAt = now
+	if _, err := jq.collection.InsertOne(ctx, job); err != nil {
+		return err
+	}
+
+	select {
+	case jq.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// EnqueueBatch stores one batch-priority job per line under a new batch id.
+// It returns an *OverloadedError if the owner already has maxBatchesPerUser
+// unfinished batches.
+func (jq *JobQueue) EnqueueBatch(owner string, lines []BatchLine) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	unfinished, err := jq.collection.Distinct(ctx, "batch_id", bson.M{
+		"owner":    owner,
+		"status":   bson.M{"$in": bson.A{JobQueued, JobRunning}},
+		"batch_id": bson.M{"$exists": true},
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(unfinished) >= maxBatchesPerUser {
+		return "", &OverloadedError{
+			Reason:     "Too many unfinished batches",
+			RetryAfter: rqManager.RetryAfter(),
+		}
+	}
+
+	batchID := primitive.NewObjectID().Hex()
+	now := time.Now()
+	docs := make([]any, len(lines))
+	for i, line := range lines {
+		docs[i] = &Job{
+			ID:        primitive.NewObjectID(),
+			Owner:     owner,
+			Query:     line.Query,
+			Params:    line.SamplingParams,
+			Priority:  PriorityBatch,
+			Status:    JobQueued,
+			BatchID:   batchID,
+			Line:      line.Line,
+			LineID:    line.ID,
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+	}
+	if _, err := jq.collection.InsertMany(ctx, docs); err != nil {
+		return "", err
+	}
+
+	select {
+	case jq.wake <- struct{}{}:
+	default:
+	}
+	return batchID, nil
+}
+
+// BatchJobs returns the jobs of owner's batch in line order.
+func (jq *JobQueue) BatchJobs(batchID string, owner string) ([]Job, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "line", Value: 1}})
+	cursor, err := jq.collection.Find(ctx, bson.M{"batch_id": batchID, "owner": owner}, opts)
+	if err != nil {
+		return nil, err
+	}
+	var jobs []Job
+	if err := cursor.All(ctx, &jobs); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// GetJob returns owner's job with the given id, or nil if there is none.
+func (jq *JobQueue) GetJob(id primitive.ObjectID, owner string) (*Job, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var job Job
+	err := jq.collection.FindOne(ctx, bson.M{"_id": id, "owner": owner}).Decode(&job)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// CancelJob cancels owner's job if it has not finished yet, reporting whether
+// it did. A job running on another instance stops at its next heartbeat.
+func (jq *JobQueue) CancelJob(id primitive.ObjectID, owner string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	filter := bson.M{
+		"_id":    id,
+		"owner":  owner,
+		"status": bson.M{"$in": bson.A{JobQueued, JobRunning}},
+	}
+	update := bson.M{
+		"$set":   bson.M{"status": JobCancelled, "error": errJobCancelled.Error(), "updated_at": time.Now()},
+		"$unset": bson.M{"lease_owner": "", "lease_expires": ""},
+	}
+	res, err := jq.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+	if res.MatchedCount == 0 {
+		return false, nil
+	}
+
+	jq.mu.Lock()
+	if stop, ok := jq.running[id]; ok {
+		stop(errJobCancelled)
+	}
+	jq.mu.Unlock()
+	return true, nil
+}
+
+// lease claims the next runnable job for this instance, or returns nil if
+// there is none: queued jobs, and running jobs whose instance stopped renewing.
+func (jq *JobQueue) lease() (*Job, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	filter := bson.M{
+		"attempts": bson.M{"$lt": jobMaxAttempts},
+		"$or": bson.A{
+			bson.M{"status": JobQueued},
+			bson.M{"status": JobRunning, "lease_expires": bson.M{"$lt": now}},
+		},
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"status":        JobRunning,
+			"lease_owner":   jq.owner,
+			"lease_expires": now.Add(jobLeaseTTL),
+			"updated_at":    now,
+		},
+		"$inc": bson.M{"attempts": 1},
+	}
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.D{{Key: "priority", Value: -1}, {Key: "created_at", Value: 1}, {Key: "line", Value: 1}}).
+		SetReturnDocument(options.After)
+
+	var job Job
+	err := jq.collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&job)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// updateLeased applies update to job only while this instance still holds its
+// lease, reporting whether it did.
+func (jq *JobQueue) updateLeased(job *Job, update bson.M) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	filter := bson.M{"_id": job.ID, "status": JobRunning, "lease_owner": jq.owner}
+	res, err := jq.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		log.Printf("[Jobs] Failed to update job %s: %v", job.ID.Hex(), err)
+		return false
+	}
+	return res.MatchedCount == 1
+}
+
+// renew extends job's lease and saves the output so far.
+func (jq *JobQueue) renew(job *Job, output string, tokens int) bool {
+	now := time.Now()
+	return jq.updateLeased(job, bson.M{"$set": bson.M{
+		"lease_expires": now.Add(jobLeaseTTL),
+		"output":        output,
+		"tokens":        tokens,
+		"updated_at":    now,
+	}})
+}
+
+// release hands job back to the queue without counting the attempt, for when
+// it could not run through no fault of its own.
+func (jq *JobQueue) release(job *Job) {
+	jq.updateLeased(job, bson.M{
+		"$set":   bson.M{"status": JobQueued, "updated_at": time.Now()},
+		"$unset": bson.M{"lease_owner": "", "lease_expires": ""},
+		"$inc":   bson.M{"attempts": -1},
+	})
+}
+
+// finish records job's outcome; summary is nil unless it completed. A failed
+// job with attempts left is queued again instead. It reports whether this
+// instance still held the lease; if not, the job was cancelled or has been
+// taken over elsewhere, and its outcome here must be discarded.
+func (jq *JobQueue) finish(job *Job, status string, output string, tokens int, summary *pb.QuerySummary, errMsg string) bool {
+	if status == JobFailed && job.Attempts < jobMaxAttempts {
+		log.Printf("[Jobs] Job %s failed (attempt %d of %d), requeueing: %s", job.ID.Hex(), job.Attempts, jobMaxAttempts, errMsg)
+		return jq.updateLeased(job, bson.M{
+			"$set":   bson.M{"status": JobQueued, "error": errMsg, "updated_at": time.Now()},
+			"$unset": bson.M{"lease_owner": "", "lease_expires": ""},
+		})
+	}
+
+	set := bson.M{
+		"status":     status,
+		"output":     output,
+		"tokens":     tokens,
+		"error":      errMsg,
+		"updated_at": time.Now(),
+	}
+	if summary != nil {
+		set["finish_reason"] = summary.FinishReason
+		set["prompt_tokens"] = summary.PromptTokens
+		set["completion_tokens"] = summary.CompletionTokens
+	}
+	return jq.updateLeased(job, bson.M{
+		"$set":   set,
+		"$unset": bson.M{"lease_owner": "", "lease_expires": ""},
+	})
+}
+
+// failAbandoned marks running jobs that expired on their last attempt as
+// failed, since lease will no longer pick them up.
+func (jq *JobQueue) failAbandoned() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	filter := bson.M{
+		"status":        JobRunning,
+		"lease_expires": bson.M{"$lt": now},
+		"attempts":      bson.M{"$gte": jobMaxAttempts},
+	}
+	update := bson.M{
+		"$set":   bson.M{"status": JobFailed, "error": "abandoned after too many attempts", "updated_at": now},
+		"$unset": bson.M{"lease_owner": "", "lease_expires": ""},
+	}
+	if _, err := jq.collection.UpdateMany(ctx, filter, update); err != nil {
+		log.Printf("[Jobs] Failed to sweep abandoned jobs: %v", err)
+	}
+}
+
+// Workers
+
+// Start runs jobWorkers workers, each feeding one job at a time through
+// rqManager, until ctx is done or the queue manager starts draining.
+func (jq *JobQueue) Start(ctx context.Context) {
+	ictx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	_, err := jq.collection.Indexes().CreateOne(ictx, mongo.IndexModel{
+		Keys: bson.D{{Key: "status", Value: 1}, {Key: "priority", Value: -1}, {Key: "created_at", Value: 1}},
+	})
+	if err != nil {
+		log.Printf("[Jobs] Failed to create index: %v", err)
+	}
+
+	for i := 0; i < jobWorkers; i++ {
+		go jq.worker(ctx)
+	}
+	log.Printf("[Jobs] Started %d worker(s) as %s", jobWorkers, jq.owner)
+}
+
+func (jq *JobQueue) worker(ctx context.Context) {
+	for ctx.Err() == nil && !rqManager.Draining() {
+		job, err := jq.lease()
+		if err != nil {
+			log.Printf("[Jobs] Failed to lease a job: %v", err)
+		}
+		if job == nil {
+			jq.failAbandoned()
+			jq.sleep(ctx, jobPollInterval)
+			continue
+		}
+		if wait := jq.run(job); wait > 0 {
+			jq.sleep(ctx, wait)
+		}
+	}
+}
+
+func (jq *JobQueue) sleep(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-jq.wake:
+	case <-ctx.Done():
+	}
+}
+
+// run feeds job through the request queue and records the outcome. It returns
+// how long the worker should back off when the queue refused the job.
+func (jq *JobQueue) run(job *Job) time.Duration {
+	params, err := job.Params.Resolve(samplingLimits)
+	if err != nil {
+		job.Attempts = jobMaxAttempts // invalid parameters stay invalid
+		jq.finish(job, JobFailed, "", 0, nil, err.Error())
+		return 0
+	}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	req := &Request{
+		query:      job.Query,
+		username:   job.Owner,
+		priority:   job.Priority,
+		ctx:        ctx,
+		cancel:     cancel,
+		responseCh: make(chan *pb.QueryResponse, 10),
+		createdAt:  time.Now(),
+		ChatID:     job.ChatID,
+		params:     params,
+		maxWait:    jobQueueWait,
+	}
+	if err := rqManager.AddRequest(req); err != nil {
+		var overloaded *OverloadedError
+		switch {
+		case errors.As(err, &overloaded):
+			jq.release(job)
+			return overloaded.RetryAfter
+		case errors.Is(err, errShuttingDown):
+			jq.release(job)
+		default:
+			// Too large for this server; trying again will not help.
+			job.Attempts = jobMaxAttempts
+			jq.finish(job, JobFailed, "", 0, nil, err.Error())
+		}
+		return 0
+	}
+	defer rqManager.Finish()
+	log.Printf("[Jobs] Running job %s as request %s", job.ID.Hex(), req.id)
+
+	jq.mu.Lock()
+	jq.running[job.ID] = cancel
+	jq.mu.Unlock()
+	defer func() {
+		jq.mu.Lock()
+		delete(jq.running, job.ID)
+		jq.mu.Unlock()
+	}()
+
+	heartbeat := time.NewTicker(jobHeartbeat)
+	defer heartbeat.Stop()
+
+	var output string
+	tokens := 0
+	for {
+		select {
+		case resp, ok := <-req.responseCh:
+			if !ok {
+				// Expired in the queue or cancelled before finishing.
+				switch cause := context.Cause(ctx); {
+				case cause == errJobLost, cause == errJobCancelled:
+				case cause == errCancelledByAdmin:
+					jq.finish(job, JobCancelled, output, tokens, nil, errCancelledByAdmin.Error())
+				case req.State() == StateExpired:
+					// Counted as an attempt, so a job cannot go round an
+					// overloaded queue forever.
+					jq.finish(job, JobFailed, output, tokens, nil, "expired in the queue")
+				default:
+					jq.release(job)
+				}
+				return jobPollInterval
+			}
+
+			switch event := resp.Event.(type) {
+			case *pb.QueryResponse_Token:
+				output += event.Token.Text
+				tokens++
+
+			case *pb.QueryResponse_Summary:
+				if !jq.finish(job, JobCompleted, output, tokens, event.Summary, "") {
+					log.Printf("[Jobs] Job %s was cancelled or taken over, discarding its result", job.ID.Hex())
+					return 0
+				}
+				log.Printf("[Jobs] Completed job %s (%s, %d tokens)", job.ID.Hex(), event.Summary.FinishReason, tokens)
+				if job.ChatID != "" {
+					SaveInteraction(ChatInteraction{
+						ChatID:    job.ChatID,
+						UserChat:  job.Query,
+						ModelChat: output,
+					})
+				}
+				return 0
+
+			case *pb.QueryResponse_Error:
+				if event.Error.Code == "shutting_down" {
+					jq.release(job)
+					return 0
+				}
+				jq.finish(job, JobFailed, output, tokens, nil, event.Error.Message)
+				return 0
+			}
+
+		case <-heartbeat.C:
+			if !jq.renew(job, output, tokens) {
+				log.Printf("[Jobs] Lost lease on job %s, stopping it", job.ID.Hex())
+				cancel(errJobLost)
+			}
+		}
+	}
+}
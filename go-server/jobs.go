@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// JobRequest is the body of POST /jobs.
+type JobRequest struct {
+	Query    string `json:"query"`
+	ChatID   string `json:"chatid,omitempty"` // if set, the result is added to this chat
+	Priority string `json:"priority,omitempty"`
+	SamplingParams
+}
+
+// Jobs run at batch priority unless the caller asks otherwise.
+const defaultJobPriority = "batch"
+
+// JobQueueMiddleware answers with 503 when the job queue is disabled.
+func JobQueueMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if jobQueue == nil {
+			return c.JSON(http.StatusServiceUnavailable, echo.Map{"error": "Jobs are not enabled"})
+		}
+		return next(c)
+	}
+}
+
+// Handler Functions
+
+func CreateJobHandler(c echo.Context) error {
+	username := c.Get("username").(string)
+	role, _ := c.Get("role").(string)
+
+	var body JobRequest
+	if err := c.Bind(&body); err != nil || body.Query == "" {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid request payload"})
+	}
+	if body.ChatID != "" {
+		if _, err := primitive.ObjectIDFromHex(body.ChatID); err != nil {
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid chat ID"})
+		}
+		// The result is added to the chat, so it must be the caller's.
+		owned, err := chatOwnedBy(body.ChatID, username)
+		if err != nil {
+			log.Printf("[Jobs] Error fetching chat %s: %v", body.ChatID, err)
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Error retrieving chat"})
+		}
+		if !owned {
+			return c.JSON(http.StatusNotFound, echo.Map{"error": "Chat not found"})
+		}
+	}
+
+	params, err := body.SamplingParams.Resolve(samplingLimits)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+	}
+	if err := checkTokenBudget(estimateTokens(body.Query, params)); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+	}
+
+	if body.Priority == "" {
+		body.Priority = defaultJobPriority
+	}
+	priority, err := resolvePriority(body.Priority, &Claims{Username: username, Role: role})
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+	}
+
+	job := &Job{
+		Owner:    username,
+		ChatID:   body.ChatID,
+		Query:    body.Query,
+		Params:   body.SamplingParams,
+		Priority: priority,
+	}
+	if err := jobQueue.Enqueue(job); err != nil {
+		var overloaded *OverloadedError
+		if errors.As(err, &overloaded) {
+			return respondOverloaded(c, overloaded)
+		}
+		log.Printf("[Jobs] Failed to enqueue job for %s: %v", username, err)
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to create job"})
+	}
+	log.Printf("[Jobs] Queued job %s for %s: %s", job.ID.Hex(), username, job.Query)
+
+	return c.JSON(http.StatusAccepted, echo.Map{"id": job.ID.Hex(), "status": job.Status})
+}
+
+func GetJobHandler(c echo.Context) error {
+	jobID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid job ID"})
+	}
+
+	job, err := jobQueue.GetJob(jobID, c.Get("username").(string))
+	if err != nil {
+		log.Printf("[Jobs] Error fetching job %s: %v", jobID.Hex(), err)
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Error retrieving job"})
+	}
+	if job == nil {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "Job not found"})
+	}
+	return c.JSON(http.StatusOK, job)
+}
+
+func CancelJobHandler(c echo.Context) error {
+	jobID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid job ID"})
+	}
+
+	cancelled, err := jobQueue.CancelJob(jobID, c.Get("username").(string))
+	if err != nil {
+		log.Printf("[Jobs] Error cancelling job %s: %v", jobID.Hex(), err)
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to cancel job"})
+	}
+	if !cancelled {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "No unfinished job with that ID"})
+	}
+	return c.JSON(http.StatusOK, echo.Map{"message": "Job cancelled"})
+}
+
+// Route Controller
+
+func JobRouteController(e *echo.Echo) {
+	jobGroup := e.Group("/jobs")
+
+	jobGroup.Use(JWTMiddleware, JobQueueMiddleware)
+	jobGroup.POST("", CreateJobHandler)
+	jobGroup.GET("/:id", GetJobHandler)
+	jobGroup.DELETE("/:id", CancelJobHandler)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/GeorgeMichailov/personalllmchat/go-server/fakemodel"
+	"github.com/GeorgeMichailov/personalllmchat/go-server/wsproto"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// A job adds its result to its chat, so nobody may name a chat of someone
+// else. The check comes before the job is stored, which would need MongoDB.
+func TestJobChatMustBeOwned(t *testing.T) {
+	defer func(prev *JobQueue) { jobQueue = prev }(jobQueue)
+	jobQueue = &JobQueue{}
+
+	writes := fakeChatWrites(t)
+	aliceChat := primitive.NewObjectID().Hex()
+	writes.owners[aliceChat] = "alice"
+
+	t.Run("REST", func(t *testing.T) {
+		body := `{"query": "mine now", "chatid": "` + aliceChat + `"}`
+		req := httptest.NewRequest(http.MethodPost, "/jobs", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(req, rec)
+		c.Set("username", "mallory")
+
+		if err := CreateJobHandler(c); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("got %d %s, want 404", rec.Code, rec.Body)
+		}
+	})
+
+	t.Run("WebSocket", func(t *testing.T) {
+		startFakeQueue(t, fakemodel.Config{})
+		conn := dialWS(t, newWSServer(t), "mallory", "", wsproto.Subprotocol)
+		writeFrame(t, conn, wsproto.TypeQuery, primitive.NewObjectID().Hex(),
+			map[string]any{"query": "mine now", "chatid": aliceChat, "async": true})
+
+		var got wsproto.Error
+		if frame := readFrame(t, conn, &got); frame.Type != wsproto.TypeError || got.Code != wsproto.CodeInvalidRequest {
+			t.Errorf("got %s %s, want an invalid_request error", frame.Type, frame.Payload)
+		}
+	})
+}
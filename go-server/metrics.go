@@ -0,0 +1,26 @@
+package main
+
+import (
+	"expvar"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Metrics are exported with expvar and served as JSON on /debug/vars.
+
+// /debug/vars needs no login, so only aggregate counts are published there;
+// who is using the queue and which backends it talks to stay on /admin/stats.
+func (rqm *RequestQueueManager) publishMetrics() {
+	expvar.Publish("queue", expvar.Func(func() any {
+		stats := rqm.Stats()
+		stats["active_users"] = len(stats["active_by_user"].(map[string]int))
+		delete(stats, "active_by_user")
+		delete(stats, "backend")
+		stats["backend_ready"] = rqm.backend.Ready()
+		return stats
+	}))
+}
+
+func MetricsRouteController(e *echo.Echo) {
+	e.GET("/debug/vars", echo.WrapHandler(expvar.Handler()))
+}
@@ -15,13 +15,15 @@ var jwtSecret = []byte("George-Temporary-Secret-Key")
 
 type Claims struct {
 	Username string `json:"username"`
+	Role     string `json:"role,omitempty"`
 	jwt.RegisteredClaims
 }
 
-func GenerateJWT(username string) (string, error) {
+func GenerateJWT(username string, role string) (string, error) {
 	expirationTime := time.Now().Add(time.Hour)
 	claims := &Claims{
 		Username: username,
+		Role:     role,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 		},
@@ -54,6 +56,7 @@ func JWTMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 		}
 
 		c.Set("username", claims.Username)
+		c.Set("role", claims.Role)
 		return next(c)
 	}
 }
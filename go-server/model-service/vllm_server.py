@@ -1,12 +1,14 @@
 import uuid
+import time
 import asyncio
 import grpc
-from vllm_service_pb2 import QueryResponse
+from vllm_service_pb2 import QueryResponse, TokenDelta, QuerySummary, QueryError
 import vllm_service_pb2_grpc
 from vllm.engine.async_llm_engine import AsyncLLMEngine
 from vllm.engine.arg_utils import AsyncEngineArgs
 from vllm.sampling_params import SamplingParams
 
+# Used when the Go server sends no sampling parameters (older clients).
 SAMPLING_PARAMS = SamplingParams(temperature=0.7, top_p=0.95, max_tokens=150)
 MODEL_NAME = "merged_model"
 engine_args = AsyncEngineArgs(
@@ -15,29 +17,65 @@ engine_args = AsyncEngineArgs(
 )
 engine = AsyncLLMEngine.from_engine_args(engine_args)
 
+def build_sampling_params(request):
+    # Limits are enforced by the Go server before the request reaches us.
+    if not request.HasField("params"):
+        return SAMPLING_PARAMS
+    params = request.params
+    return SamplingParams(
+        temperature=params.temperature,
+        top_p=params.top_p,
+        top_k=params.top_k,
+        max_tokens=params.max_tokens,
+        stop=list(params.stop) or None,
+        seed=params.seed if params.HasField("seed") else None,
+        repetition_penalty=params.repetition_penalty,
+    )
+
 class VLLMServiceServicer(vllm_service_pb2_grpc.VLLMServiceServicer):
     async def Query(self, request, context):
         print(f"[gRPC Server] Received query: {request.query}")
-        async for token in self.stream_inference_async(request.query):
-            print(f"[gRPC Server] Sending token: '{token}' for query: {request.query}")
-            yield QueryResponse(token=token)
+        sampling_params = build_sampling_params(request)
+        try:
+            async for response in self.stream_inference_async(request.query, sampling_params):
+                yield response
+        except Exception as e:
+            print(f"[gRPC Server] Generation failed for query: {request.query}: {e}")
+            yield QueryResponse(error=QueryError(code="internal", message=str(e)))
+            return
         print(f"[gRPC Server] Completed query: {request.query}")
 
-    async def stream_inference_async(self, query: str):
+    async def stream_inference_async(self, query: str, sampling_params: SamplingParams):
         print(f"[DEBUG] Full Prompt Sent to Model:\n{query}")
         request_id = str(uuid.uuid4())
+        started = time.monotonic()
         currently_seen = 0
         debug = ""
-        async for request_output in engine.generate(query, SAMPLING_PARAMS, request_id):
-            for output in request_output.outputs:
+        finished = False
+        try:
+            async for request_output in engine.generate(query, sampling_params, request_id):
+                output = request_output.outputs[0]
                 debug = output.text
                 partial_text = output.text[currently_seen:]
                 currently_seen = len(output.text)
-                yield partial_text
-            if request_output.finished:
-                print(f"[DEBUG]: MODEL FULL RESPONSE TO QUERY: {debug}")
-                break
-        yield "[END]"
+                if partial_text:
+                    print(f"[gRPC Server] Sending token: '{partial_text}' for query: {query}")
+                    yield QueryResponse(token=TokenDelta(text=partial_text))
+                if request_output.finished:
+                    finished = True
+                    print(f"[DEBUG]: MODEL FULL RESPONSE TO QUERY: {debug}")
+                    yield QueryResponse(summary=QuerySummary(
+                        finish_reason=output.finish_reason or "stop",
+                        prompt_tokens=len(request_output.prompt_token_ids or []),
+                        completion_tokens=len(output.token_ids),
+                        latency_ms=int((time.monotonic() - started) * 1000),
+                    ))
+                    break
+        finally:
+            # The Go server cancels the RPC when its client goes away; stop generating too.
+            if not finished:
+                print(f"[gRPC Server] Aborting request {request_id} for query: {query}")
+                await engine.abort(request_id)
 
 async def serve():
     server = grpc.aio.server()
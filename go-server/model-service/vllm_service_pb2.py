@@ -24,7 +24,7 @@ _sym_db = _symbol_database.Default()
 
 
 
-DESCRIPTOR = _descriptor_pool.Default().AddSerializedFile(b'\n\x12vllm_service.proto\x12\x04vllm\"\x1d\n\x0cQueryRequest\x12\r\n\x05query\x18\x01 \x01(\t\"\x1e\n\rQueryResponse\x12\r\n\x05token\x18\x01 \x01(\t2A\n\x0bVLLMService\x12\x32\n\x05Query\x12\x12.vllm.QueryRequest\x1a\x13.vllm.QueryResponse0\x01\x42\x44ZBgithub.com/GeorgeMichailov/personalllmchat/go-server/model-serviceb\x06proto3')
+DESCRIPTOR = _descriptor_pool.Default().AddSerializedFile(b'\n\x12vllm_service.proto\x12\x04vllm\"C\n\x0cQueryRequest\x12\r\n\x05query\x18\x01 \x01(\t\x12$\n\x06params\x18\x02 \x01(\x0b\x32\x14.vllm.SamplingParams\"\x9d\x01\n\x0eSamplingParams\x12\x13\n\x0btemperature\x18\x01 \x01(\x02\x12\r\n\x05top_p\x18\x02 \x01(\x02\x12\r\n\x05top_k\x18\x03 \x01(\x05\x12\x12\n\nmax_tokens\x18\x04 \x01(\x05\x12\x0c\n\x04stop\x18\x05 \x03(\t\x12\x11\n\x04seed\x18\x06 \x01(\x03H\x00\x88\x01\x01\x12\x1a\n\x12repetition_penalty\x18\x07 \x01(\x02\x42\x07\n\x05_seed\"\x8b\x01\n\rQueryResponse\x12!\n\x05token\x18\x02 \x01(\x0b\x32\x10.vllm.TokenDeltaH\x00\x12%\n\x07summary\x18\x03 \x01(\x0b\x32\x12.vllm.QuerySummaryH\x00\x12!\n\x05\x65rror\x18\x04 \x01(\x0b\x32\x10.vllm.QueryErrorH\x00\x42\x07\n\x05\x65ventJ\x04\x08\x01\x10\x02\"\x1a\n\nTokenDelta\x12\x0c\n\x04text\x18\x01 \x01(\t\"k\n\x0cQuerySummary\x12\x15\n\rfinish_reason\x18\x01 \x01(\t\x12\x15\n\rprompt_tokens\x18\x02 \x01(\x05\x12\x19\n\x11\x63ompletion_tokens\x18\x03 \x01(\x05\x12\x12\n\nlatency_ms\x18\x04 \x01(\x03\"+\n\nQueryError\x12\x0c\n\x04\x63ode\x18\x01 \x01(\t\x12\x0f\n\x07message\x18\x02 \x01(\t2A\n\x0bVLLMService\x12\x32\n\x05Query\x12\x12.vllm.QueryRequest\x1a\x13.vllm.QueryResponse0\x01\x42\x44ZBgithub.com/GeorgeMichailov/personalllmchat/go-server/model-serviceb\x06proto3')
 
 _globals = globals()
 _builder.BuildMessageAndEnumDescriptors(DESCRIPTOR, _globals)
@@ -33,9 +33,17 @@ if not _descriptor._USE_C_DESCRIPTORS:
   _globals['DESCRIPTOR']._loaded_options = None
   _globals['DESCRIPTOR']._serialized_options = b'ZBgithub.com/GeorgeMichailov/personalllmchat/go-server/model-service'
   _globals['_QUERYREQUEST']._serialized_start=28
-  _globals['_QUERYREQUEST']._serialized_end=57
-  _globals['_QUERYRESPONSE']._serialized_start=59
-  _globals['_QUERYRESPONSE']._serialized_end=89
-  _globals['_VLLMSERVICE']._serialized_start=91
-  _globals['_VLLMSERVICE']._serialized_end=156
+  _globals['_QUERYREQUEST']._serialized_end=95
+  _globals['_SAMPLINGPARAMS']._serialized_start=98
+  _globals['_SAMPLINGPARAMS']._serialized_end=255
+  _globals['_QUERYRESPONSE']._serialized_start=258
+  _globals['_QUERYRESPONSE']._serialized_end=397
+  _globals['_TOKENDELTA']._serialized_start=399
+  _globals['_TOKENDELTA']._serialized_end=425
+  _globals['_QUERYSUMMARY']._serialized_start=427
+  _globals['_QUERYSUMMARY']._serialized_end=534
+  _globals['_QUERYERROR']._serialized_start=536
+  _globals['_QUERYERROR']._serialized_end=579
+  _globals['_VLLMSERVICE']._serialized_start=581
+  _globals['_VLLMSERVICE']._serialized_end=646
 # @@protoc_insertion_point(module_scope)
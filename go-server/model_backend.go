@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	pb "github.com/GeorgeMichailov/personalllmchat/go-server/model-service"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+var modelServiceAddr = envString("MODEL_SERVICE_ADDR", "localhost:50051")
+
+const (
+	backendPoolSize   = 2
+	backendBaseDelay  = 500 * time.Millisecond
+	backendMaxDelay   = 30 * time.Second
+	backendMinConnect = 5 * time.Second
+)
+
+var errBackendUnavailable = errors.New("model backend unavailable")
+
+// BackendPool keeps a fixed set of long-lived gRPC connections to the model
+// service. gRPC itself redials broken connections with exponential backoff;
+// the pool watches their connectivity so callers can tell whether any
+// connection is usable before dispatching work.
+type BackendPool struct {
+	addr  string
+	size  int
+	conns []*backendConn
+
+	mu    sync.Mutex
+	next  int
+	ready int
+
+	onReady func() // called when the pool goes from no ready connection to one
+}
+
+type backendConn struct {
+	name   string // addr#index, identifies the connection in introspection
+	conn   *grpc.ClientConn
+	client pb.VLLMServiceClient
+	state  connectivity.State
+}
+
+func createBackendPool(addr string, size int) *BackendPool {
+	return &BackendPool{
+		addr:  addr,
+		size:  size,
+		conns: make([]*backendConn, 0, size),
+	}
+}
+
+// Start dials every connection in the pool and watches them until ctx is done,
+// at which point the connections are closed.
+func (bp *BackendPool) Start(ctx context.Context) error {
+	for i := 0; i < bp.size; i++ {
+		conn, err := grpc.NewClient(bp.addr,
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+			grpc.WithConnectParams(grpc.ConnectParams{
+				Backoff: backoff.Config{
+					BaseDelay:  backendBaseDelay,
+					Multiplier: backoff.DefaultConfig.Multiplier,
+					Jitter:     backoff.DefaultConfig.Jitter,
+					MaxDelay:   backendMaxDelay,
+				},
+				MinConnectTimeout: backendMinConnect,
+			}),
+		)
+		if err != nil {
+			bp.Close()
+			return err
+		}
+		bc := &backendConn{
+			name:   fmt.Sprintf("%s#%d", bp.addr, i),
+			conn:   conn,
+			client: pb.NewVLLMServiceClient(conn),
+			state:  connectivity.Idle,
+		}
+		bp.mu.Lock()
+		bp.conns = append(bp.conns, bc)
+		bp.mu.Unlock()
+		conn.Connect()
+		go bp.watch(ctx, i, bc)
+	}
+
+	go func() {
+		<-ctx.Done()
+		bp.Close()
+	}()
+
+	log.Printf("[Backend] Started %d connection(s) to %s", bp.size, bp.addr)
+	return nil
+}
+
+// watch tracks connectivity changes of one connection. Idle connections are
+// kicked back into connecting so the pool never sits on a lazy connection.
+func (bp *BackendPool) watch(ctx context.Context, idx int, bc *backendConn) {
+	for {
+		state := bc.conn.GetState()
+		if bp.setState(idx, bc, state) && bp.onReady != nil {
+			bp.onReady()
+		}
+
+		if state == connectivity.Shutdown {
+			return
+		}
+		if state == connectivity.Idle {
+			bc.conn.Connect()
+		}
+		if !bc.conn.WaitForStateChange(ctx, state) {
+			return
+		}
+	}
+}
+
+// setState records a connection's new state and reports whether the pool just
+// became ready.
+func (bp *BackendPool) setState(idx int, bc *backendConn, state connectivity.State) bool {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	prev := bc.state
+	if prev == state {
+		return false
+	}
+	bc.state = state
+	log.Printf("[Backend] Connection %d: %s -> %s", idx, prev, state)
+
+	if prev == connectivity.Ready {
+		bp.ready--
+		if bp.ready == 0 {
+			log.Printf("[Backend] No ready connections to %s, dispatching paused", bp.addr)
+		}
+	}
+	if state == connectivity.Ready {
+		bp.ready++
+		if bp.ready == 1 {
+			log.Printf("[Backend] Connected to %s, dispatching resumed", bp.addr)
+			return true
+		}
+	}
+	return false
+}
+
+// Ready reports whether at least one connection can currently serve a query.
+func (bp *BackendPool) Ready() bool {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	return bp.ready > 0
+}
+
+// Client returns a ready connection's client and name, rotating between
+// connections.
+func (bp *BackendPool) Client() (pb.VLLMServiceClient, string, error) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	n := len(bp.conns)
+	bp.next++
+	for i := 0; i < n; i++ {
+		bc := bp.conns[(bp.next+i)%n]
+		if bc.state == connectivity.Ready {
+			return bc.client, bc.name, nil
+		}
+	}
+	return nil, "", errBackendUnavailable
+}
+
+// Status reports the connectivity state of each connection, keyed by name.
+func (bp *BackendPool) Status() map[string]string {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	status := make(map[string]string, len(bp.conns))
+	for _, bc := range bp.conns {
+		status[bc.name] = bc.state.String()
+	}
+	return status
+}
+
+func (bp *BackendPool) Close() {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	for _, bc := range bp.conns {
+		bc.conn.Close()
+	}
+}
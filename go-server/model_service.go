@@ -2,191 +2,191 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
-	"sync"
+	"strconv"
 	"time"
 
 	pb "github.com/GeorgeMichailov/personalllmchat/go-server/model-service"
+	"github.com/GeorgeMichailov/personalllmchat/go-server/wsproto"
 
 	"github.com/gorilla/websocket"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 const (
-	gracePeriod      = 5 * time.Second
-	scanInterval     = 500 * time.Millisecond
 	grpcQueryTimeout = 120 * time.Second // Increased timeout for gRPC query
-	grpcDialTimeout  = 60 * time.Second  // Increased dial timeout
-	websocketTimeout = grpcDialTimeout   // gracePeriod + 2*time.Second // Increased WS timeout and added margin
+	websocketTimeout = 60 * time.Second  // longest wait for the next event of an answer
 	maxMessageSize   = 512
 )
 
-type Request struct {
-	query      string
-	responseCh chan string
-	createdAt  time.Time
-	isActive   bool
-	isComplete bool
-	ChatID     string
-}
-
 type IncomingWSMessage struct {
-	Claims Claims `json:"claims,omitempty"`
-	Query  string `json:"query"`
-	ChatID string `json:"chatid"`
-}
-
-type RequestQueueManager struct {
-	queue            []*Request
-	activeQueries    int8
-	maxActiveQueries int8
-	mu               sync.Mutex
-	cond             *sync.Cond
-}
-
-func createRequestQueueManager() *RequestQueueManager {
-	rqm := &RequestQueueManager{
-		queue:            make([]*Request, 0, 30),
-		maxActiveQueries: 5,
-		activeQueries:    0,
-	}
-	rqm.cond = sync.NewCond(&rqm.mu)
-	return rqm
-}
-
-func (rqm *RequestQueueManager) AddRequest(req *Request) {
-	log.Printf("[Queue] Adding new request: %s", req.query)
-	rqm.mu.Lock()
-	rqm.queue = append(rqm.queue, req)
-	rqm.mu.Unlock()
-	rqm.cond.Signal()
+	Claims    Claims `json:"claims,omitempty"`
+	RequestID string `json:"request_id,omitempty"` // names the query's frames in a session
+	Query     string `json:"query"`
+	ChatID    string `json:"chatid"`
+	Priority  string `json:"priority,omitempty"`
+	Status    bool   `json:"status,omitempty"`   // opt in to QueueStatus frames
+	Async     bool   `json:"async,omitempty"`    // run as a job; the result goes to the chat
+	NoCache   bool   `json:"no_cache,omitempty"` // always ask the model, see ResponseCache
+	// Not a query: stop answering request_id. "stop" is taken by the stop
+	// sequences of SamplingParams.
+	StopGenerating bool `json:"stop_generating,omitempty"`
+	SamplingParams
 }
 
-func (rqm *RequestQueueManager) Start(ctx context.Context) {
-	// Routine: Scans for expired requests. Closes their channel and removes from queue.
-	go func() {
-		ticker := time.NewTicker(scanInterval)
-		defer ticker.Stop()
-		for {
-			select {
-			case <-ticker.C:
-				rqm.mu.Lock()
-				var freshQueue []*Request
-				for _, req := range rqm.queue {
-					if req.isComplete {
-						continue
-					}
-					now := time.Now()
-
-					// If request is stale: log and close the channel.
-					if now.Sub(req.createdAt) > gracePeriod && !req.isActive {
-						log.Printf("[Queue Timeout] Request expired for query: %s", req.query)
-						close(req.responseCh)
-						continue
-					}
-
-					// If request is pending and there is capacity: dispatch it.
-					if !req.isActive && rqm.activeQueries < rqm.maxActiveQueries {
-						log.Printf("[Dispatch] Dispatching query: %s", req.query)
-						req.isActive = true
-						rqm.activeQueries++
-						go func(r *Request) {
-							vLlmInteractor(r)
-							rqm.mu.Lock()
-							r.isActive = false
-							rqm.activeQueries--
-							rqm.mu.Unlock()
-						}(req)
-						continue
-					}
-
-					freshQueue = append(freshQueue, req)
-				}
-				rqm.queue = freshQueue
-				rqm.mu.Unlock()
-			case <-ctx.Done():
-				log.Printf("[Queue] Context done, stopping queue manager.")
-				return
-			}
+func vLlmInteractor(client pb.VLLMServiceClient, req *Request) {
+	state := streamQuery(client, req)
+	if req.gen != nil {
+		req.gen.end(state)
+		// The stream may have outlived req for the sake of its followers.
+		if req.ctx.Err() != nil {
+			state = StateCancelled
 		}
-	}()
+	}
+	req.transition(state)
 }
 
-func vLlmInteractor(req *Request) {
-	_, dialCancel := context.WithTimeout(context.Background(), grpcDialTimeout)
-	defer dialCancel()
-
-	log.Printf("[gRPC NewClient] Attempting to create a new client for query: %s", req.query)
-	grpcConn, err := grpc.NewClient("localhost:50051",
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
-	)
-	if err != nil {
-		log.Printf("[Timeout: gRPC NewClient] Failed to create new client: %v for query: %s", err, req.query)
-		close(req.responseCh)
-		return
+// streamQuery relays the model's events for req and returns the terminal state
+// the request ended in.
+func streamQuery(client pb.VLLMServiceClient, req *Request) RequestState {
+	// Cancelling the stream's context makes vLLM abort the generation. A shared
+	// generation has its own, cancelled once none of its requests want it.
+	streamCtx := req.ctx
+	if req.gen != nil {
+		streamCtx = req.gen.ctx
 	}
-	defer grpcConn.Close()
-	log.Printf("[gRPC NewClient] Client created successfully for query: %s", req.query)
-	queryCtx, queryCancel := context.WithTimeout(context.Background(), grpcQueryTimeout)
+	queryCtx, queryCancel := context.WithTimeout(streamCtx, grpcQueryTimeout)
 	defer queryCancel()
 
-	gReq := &pb.QueryRequest{Query: req.query}
-	client := pb.NewVLLMServiceClient(grpcConn)
+	gReq := &pb.QueryRequest{Query: req.query, Params: req.params}
 	log.Printf("[gRPC Query] Sending query to gRPC server: %s", req.query)
 	stream, err := client.Query(queryCtx, gReq)
 	if err != nil {
+		if streamCtx.Err() != nil {
+			log.Printf("[gRPC Cancelled] Client went away for query: %s", req.query)
+			return StateCancelled
+		}
 		log.Printf("[gRPC Query Error] %v for query: %s", err, req.query)
-		close(req.responseCh)
-		return
+		req.emit(streamErrorEvent(err))
+		return StateFailed
 	}
 
-	// Read tokens from the gRPC stream
+	var tokens []string // kept only if the response will be cached
+
+	// Read events from the gRPC stream until a summary or error ends it
 	for {
 		resp, err := stream.Recv()
 		if err != nil {
+			if streamCtx.Err() != nil {
+				log.Printf("[gRPC Cancelled] Client went away for query: %s", req.query)
+				return StateCancelled
+			}
 			log.Printf("[gRPC Recv Error] %v for query: %s", err, req.query)
-			break
+			if err == io.EOF {
+				err = errors.New("model stream ended without a summary")
+			}
+			req.emit(streamErrorEvent(err))
+			return StateFailed
 		}
-		log.Printf("[gRPC Token] Received token: '%s' for query: %s", resp.Token, req.query)
-		req.responseCh <- resp.Token
-		if resp.Token == "[END]" {
-			log.Printf("[gRPC Complete] Finished query: %s", req.query)
-			break
+
+		switch event := resp.Event.(type) {
+		case *pb.QueryResponse_Token:
+			log.Printf("[gRPC Token] Received token: '%s' for query: %s", event.Token.Text, req.query)
+			now := time.Now()
+			if req.State() == StateDispatched {
+				req.transition(StateStreaming)
+				req.firstTokenAt = now
+			}
+			req.lastTokenAt = now
+			req.tokenCount.Add(1)
+			if req.cacheKey != "" {
+				tokens = append(tokens, event.Token.Text)
+			}
+			// A failed send means req.ctx is done; unless followers still want
+			// the stream, the next Recv reports it.
+			req.emit(resp)
+		case *pb.QueryResponse_Summary:
+			log.Printf("[gRPC Complete] Finished query (%s, %d tokens, %dms): %s",
+				event.Summary.FinishReason, event.Summary.CompletionTokens, event.Summary.LatencyMs, req.query)
+			if req.cacheKey != "" {
+				responseCache.Store(req.cacheKey, tokens, event.Summary)
+			}
+			req.emit(resp)
+			return StateCompleted
+		case *pb.QueryResponse_Error:
+			log.Printf("[gRPC Model Error] %s: %s for query: %s", event.Error.Code, event.Error.Message, req.query)
+			req.emit(resp)
+			return StateFailed
+		default:
+			log.Printf("[gRPC Recv Error] Unknown event %T for query: %s", resp.Event, req.query)
 		}
 	}
-	close(req.responseCh)
-	req.isComplete = true
 }
 
-var rqManager *RequestQueueManager = createRequestQueueManager()
+// streamErrorEvent wraps a transport failure as an error event so consumers of
+// responseCh only ever have to handle typed events.
+func streamErrorEvent(err error) *pb.QueryResponse {
+	code := "unavailable"
+	if st, ok := status.FromError(err); ok && st.Code() == codes.DeadlineExceeded {
+		code = "timeout"
+	}
+	return &pb.QueryResponse{Event: &pb.QueryResponse_Error{
+		Error: &pb.QueryError{Code: code, Message: err.Error()},
+	}}
+}
+
+var errClientGone = errors.New("client disconnected")
+
+// A stopped answer ends like a complete one, with wsproto.FinishStopped as
+// its finish reason, and the part the user has seen is kept in the chat.
+var errStoppedByUser = errors.New(wsproto.FinishStopped)
 
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	Subprotocols:    []string{wsproto.Subprotocol},
 }
 
+// wsHandler answers a single query and closes, unless the client asks for a
+// session with /ws?session=1, see serveSession. Clients that offer
+// wsproto.Subprotocol are answered in typed frames.
 func wsHandler(w http.ResponseWriter, r *http.Request) {
-	_, err := wsJWTCheck(r)
+	claims, err := wsJWTCheck(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+	if rqManager.Draining() {
+		http.Error(w, errShuttingDown.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	session, _ := strconv.ParseBool(r.URL.Query().Get("session"))
+
+	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("[WebSocket Upgrade Error] %v", err)
 		return
 	}
+	conn := &wsConn{Conn: ws, typed: ws.Subprotocol() == wsproto.Subprotocol}
 	defer conn.Close()
 
 	conn.SetCloseHandler(func(code int, text string) error {
 		log.Printf("WebSocket closed: %d - %s\n", code, text)
 		return nil
 	})
-	conn.SetReadLimit(512)
+	conn.SetReadLimit(maxMessageSize)
+
+	if session {
+		serveSession(conn, claims)
+		return
+	}
 
 	_, message, err := conn.ReadMessage()
 	if err != nil {
@@ -194,121 +194,382 @@ func wsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var incoming IncomingWSMessage
-	if err := json.Unmarshal(message, &incoming); err != nil {
-		conn.WriteMessage(websocket.TextMessage, []byte(`{"error":"Invalid JSON format"}`))
+	frame, incoming, err := conn.decodeMessage(message)
+	if err == nil && (frame.Type == wsproto.TypeCancel || frame.Type == wsproto.TypeStop) {
+		err = fmt.Errorf("unexpected %q frame", frame.Type)
+	}
+	if err != nil {
+		newReply(conn, frame.RequestID).error(wsproto.CodeInvalidRequest, err.Error())
 		return
 	}
-	log.Printf("Received message for ChatID [%s]: %s\n", incoming.ChatID, incoming.Query)
 
-	if len(incoming.ChatID) == 0 {
-		success, newchatid := CreateNewUserChat(incoming.Claims.Username)
+	// After its first message the client only sends stop messages, so a
+	// read error means the socket was closed or broke.
+	stops := make(chan string, 1)
+	gone := make(chan struct{})
+	go func() {
+		for {
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				close(gone)
+				return
+			}
+			if stop, _, err := conn.decodeMessage(message); err == nil && stop.Type == wsproto.TypeStop {
+				select {
+				case stops <- stop.RequestID:
+				default:
+				}
+			}
+		}
+	}()
+	// The request id may be left out of a stop message, there being only one.
+	stopsThis := func(requestID string) bool {
+		return requestID == "" || requestID == frame.RequestID || requestID == incoming.RequestID
+	}
 
-		if !success {
-			conn.WriteMessage(websocket.TextMessage, []byte(`{"error" : "Failed to add chat to user."}`))
+	if frame.Type == wsproto.TypeResume {
+		st := lookupStream(claims.Username, frame.RequestID)
+		if st == nil {
+			newReply(conn, frame.RequestID).error(wsproto.CodeNotResumable, errNotResumable.Error())
 			return
 		}
+		st.attach(conn, frame.Seq)
+		for {
+			select {
+			case requestID := <-stops:
+				if stopsThis(requestID) {
+					st.cancel(errStoppedByUser)
+				}
+			case <-st.done:
+				return
+			case <-gone:
+				st.detach(conn)
+				return
+			}
+		}
+	}
 
-		incoming.ChatID = newchatid.Hex()
+	if conn.typed && incoming.RequestID == "" {
+		incoming.RequestID = primitive.NewObjectID().Hex()
 	}
 
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	reply := newReply(conn, incoming.RequestID)
+	if conn.typed {
+		// A typed answer does not depend on the connection, see ws_resume.go.
+		st, err := retainStream(conn, claims.Username, incoming.RequestID, cancel)
+		if err != nil {
+			reply.error(wsproto.CodeInvalidRequest, err.Error())
+			return
+		}
+		reply.stream = st
+		defer reply.stream.end()
+	}
+	go func() {
+		for {
+			select {
+			case requestID := <-stops:
+				if stopsThis(requestID) {
+					cancel(errStoppedByUser)
+				}
+			case <-gone:
+				if reply.stream != nil {
+					reply.stream.detach(conn)
+				} else {
+					// Cancel so the queue slot is freed right away.
+					cancel(errClientGone)
+				}
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	serveQuery(ctx, reply, claims, &incoming)
+}
+
+// serveQuery answers one query through reply. It returns once the answer is
+// complete or the request has ended otherwise; cancelling ctx cancels it.
+func serveQuery(ctx context.Context, reply *wsReply, claims *Claims, incoming *IncomingWSMessage) {
+	log.Printf("Received message for ChatID [%s]: %s\n", incoming.ChatID, incoming.Query)
+
+	params, err := incoming.SamplingParams.Resolve(samplingLimits)
+	if err != nil {
+		reply.error(wsproto.CodeInvalidRequest, err.Error())
+		return
+	}
+
+	priority, err := resolvePriority(incoming.Priority, claims)
+	if err != nil {
+		reply.error(wsproto.CodeInvalidRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
 	req := &Request{
 		query:      incoming.Query,
-		responseCh: make(chan string, 10),
+		username:   claims.Username,
+		priority:   priority,
+		ctx:        ctx,
+		cancel:     cancel,
+		responseCh: make(chan *pb.QueryResponse, 10),
 		createdAt:  time.Now(),
-		isActive:   false,
-		isComplete: false,
 		ChatID:     incoming.ChatID,
+		params:     params,
+	}
+	if incoming.Status {
+		req.statusCh = make(chan QueueStatus, 1)
+	}
+	if !incoming.NoCache {
+		req.cacheKey = cacheKey(incoming.Query, params)
+	}
+
+	var cached *cachedResponse
+	if req.cacheKey != "" && !incoming.Async {
+		cached = responseCache.Lookup(req.cacheKey)
+	}
+	// Refuse what the queue would refuse before creating a chat for it, so a
+	// rejected request does not leave an empty chat behind.
+	switch {
+	case incoming.Async:
+		if !admitAsync(reply, claims, incoming, params) {
+			return
+		}
+	case cached != nil:
+		// A replay takes no slot, but no answer is started once shutdown
+		// has begun.
+		if rqManager.Draining() {
+			reply.refused(errShuttingDown)
+			return
+		}
+	default:
+		if err := rqManager.CheckAdmission(req); err != nil {
+			reply.refused(err)
+			return
+		}
 	}
 
-	rqManager.AddRequest(req)
 	var modelResponse string
+	sawToken := false
+	tokensSent := 0
+	newChat := false // created for this query
+
+	writeStatus := func(st QueueStatus) {
+		if incoming.Status {
+			reply.status(st)
+		}
+	}
+	// Flush a pending status before token frames so updates arrive in order.
+	flushStatus := func() {
+		select {
+		case st := <-req.statusCh:
+			writeStatus(st)
+		default:
+		}
+	}
+
+	finish := func(summary *pb.QuerySummary) {
+		writeStatus(QueueStatus{Status: "completed", FinishReason: summary.FinishReason, Cached: cached != nil})
+		if err := reply.done(summary, cached != nil); err != nil {
+			log.Printf("[WebSocket Write Error] %v for query: %s", err, incoming.Query)
+		}
+		log.Printf("[WebSocket] Completed sending tokens (%s) for query: %s", summary.FinishReason, incoming.Query)
+	}
+
+	// Tell the client why the server stopped its request. A generation cut
+	// short by the user or by shutdown keeps what the user has already seen.
+	reportCancel := func() {
+		switch cause := context.Cause(ctx); cause {
+		case errStoppedByUser:
+			finish(&pb.QuerySummary{FinishReason: wsproto.FinishStopped, CompletionTokens: int32(tokensSent)})
+			if !sawToken {
+				// Nothing to keep, and a chat made for it would stay empty.
+				if newChat {
+					deleteUserChat(claims.Username, req.ChatID)
+				}
+				return
+			}
+			SaveInteraction(ChatInteraction{
+				ChatID:       req.ChatID,
+				UserChat:     incoming.Query,
+				ModelChat:    modelResponse,
+				FinishReason: wsproto.FinishStopped,
+			})
+		case errClientGone:
+			log.Printf("[WebSocket] Client disconnected for query: %s", incoming.Query)
+		case errCancelledByAdmin, errCancelledByClient:
+			reply.error(wsproto.CodeCancelled, cause.Error())
+		case errShuttingDown:
+			if !sawToken {
+				return
+			}
+			reply.error(wsproto.CodeShuttingDown, cause.Error())
+			SaveInteraction(ChatInteraction{
+				ChatID:    req.ChatID,
+				UserChat:  incoming.Query,
+				ModelChat: modelResponse,
+			})
+		}
+	}
+
+	// A query stopped or cancelled before it was started, e.g. while queued
+	// behind another on an untyped session, gets no chat.
+	if ctx.Err() != nil {
+		reportCancel()
+		return
+	}
+
+	if len(incoming.ChatID) == 0 {
+		success, newchatid := createUserChat(claims.Username)
+
+		if !success {
+			reply.error(wsproto.CodeInternal, "Failed to add chat to user.")
+			return
+		}
+
+		incoming.ChatID = newchatid.Hex()
+		req.ChatID = incoming.ChatID
+		newChat = true
+	}
+
+	// A client needs the chat id to send the next turn to the same chat.
+	reply.accepted(incoming.ChatID)
+
+	if incoming.Async {
+		enqueueAsync(reply, claims, incoming, priority)
+		return
+	}
+
+	if cached != nil {
+		go cached.replay(req)
+	} else {
+		if err := rqManager.AddRequest(req); err != nil {
+			reply.refused(err)
+			return
+		}
+		defer rqManager.Finish()
+	}
 
 	for {
 		select {
-		case token, ok := <-req.responseCh:
+		case st := <-req.statusCh:
+			writeStatus(st)
+
+		case resp, ok := <-req.responseCh:
 			if !ok {
 				log.Printf("[WebSocket] Response channel closed for query: %s", incoming.Query)
+				if req.State() == StateExpired {
+					writeStatus(QueueStatus{Status: "expired"})
+					reply.expired()
+				}
+				reportCancel()
 				return
 			}
+			flushStatus()
 
-			if err := conn.WriteMessage(websocket.TextMessage, []byte(token)); err != nil {
-				log.Printf("[WebSocket Write Error] %v for query: %s", err, incoming.Query)
-				return
-			}
+			switch event := resp.Event.(type) {
+			case *pb.QueryResponse_Token:
+				if !sawToken {
+					sawToken = true
+					writeStatus(QueueStatus{Status: "first_token"})
+				}
+				if err := reply.token(event.Token.Text); err != nil {
+					log.Printf("[WebSocket Write Error] %v for query: %s", err, incoming.Query)
+					return
+				}
+				modelResponse += event.Token.Text
+				tokensSent++
 
-			if token != "[END]" {
-				modelResponse += token
-			} else {
-				log.Printf("[WebSocket] Completed sending tokens for query: %s", incoming.Query)
+			case *pb.QueryResponse_Summary:
+				finish(event.Summary)
 				interaction := ChatInteraction{
 					ChatID:    req.ChatID,
 					UserChat:  incoming.Query,
 					ModelChat: modelResponse,
 				}
 
-				go AddInteraction(interaction)
+				SaveInteraction(interaction)
+				return
+
+			case *pb.QueryResponse_Error:
+				reply.error(event.Error.Code, event.Error.Message)
 				return
 			}
+		case <-ctx.Done():
+			reportCancel()
+			return
 		case <-time.After(websocketTimeout):
 			log.Printf("[Timeout: WebSocket Response] No response received in %v for query: %s", websocketTimeout, incoming.Query)
-			conn.WriteMessage(websocket.TextMessage, []byte("Timeout: no response received."))
+			reply.timeout()
 			return
 		}
 	}
 }
 
-/*
-func SimulationWsHandler(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Printf("[WebSocket Upgrade Error] %v", err)
-		return
+// admitAsync reports whether the query can be stored as a job, telling the
+// client why not otherwise.
+func admitAsync(reply *wsReply, claims *Claims, incoming *IncomingWSMessage, params *pb.SamplingParams) bool {
+	if jobQueue == nil {
+		reply.error(wsproto.CodeNotEnabled, "Asynchronous requests are not enabled")
+		return false
 	}
-	defer conn.Close()
-
-	_, message, err := conn.ReadMessage()
-	if err != nil {
-		log.Printf("[WebSocket Read Error] %v", err)
-		return
+	if err := checkTokenBudget(estimateTokens(incoming.Query, params)); err != nil {
+		reply.error(wsproto.CodeInvalidRequest, err.Error())
+		return false
 	}
-
-	var incoming IncomingWSMessage
-	if err := json.Unmarshal(message, &incoming); err != nil {
-		conn.WriteMessage(websocket.TextMessage, []byte(`{"error":"Invalid JSON format"}`))
-		return
+	// The job adds its result to the chat, so it must be the caller's.
+	if incoming.ChatID != "" {
+		owned, err := chatOwnedBy(incoming.ChatID, claims.Username)
+		if err != nil {
+			log.Printf("[Jobs] Error fetching chat %s: %v", incoming.ChatID, err)
+			reply.error(wsproto.CodeInternal, "Error retrieving chat")
+			return false
+		}
+		if !owned {
+			reply.error(wsproto.CodeInvalidRequest, "Chat not found")
+			return false
+		}
 	}
-	log.Printf("Received message for ChatID [%s]: %s\n", incoming.ChatID, incoming.Query)
-
-	if len(incoming.ChatID) == 0 {
-		success, newchatid := CreateNewUserChat(incoming.Claims.Username)
-
-		if !success {
-			conn.WriteMessage(websocket.TextMessage, []byte(`{"error" : "Failed to add chat to user."}`))
-			return
+	if err := jobQueue.CheckAdmission(claims.Username); err != nil {
+		var overloaded *OverloadedError
+		if errors.As(err, &overloaded) {
+			reply.overloaded(overloaded)
+			return false
 		}
-
-		incoming.ChatID = newchatid.Hex()
+		log.Printf("[Jobs] Failed to check the jobs of %s: %v", claims.Username, err)
+		reply.error(wsproto.CodeInternal, "Failed to queue request")
+		return false
 	}
+	return true
+}
 
-	modelResponse := "Simulated response"
-
-	if err := conn.WriteMessage(websocket.TextMessage, []byte(modelResponse)); err != nil {
-		log.Printf("[WebSocket Write Error] %v for query: %s", err, incoming.Query)
-		return
+// enqueueAsync stores the query as a job and tells the client its id. The
+// client may disconnect right away; the answer is added to the chat. The
+// checks of admitAsync have been made.
+func enqueueAsync(reply *wsReply, claims *Claims, incoming *IncomingWSMessage, priority Priority) {
+	job := &Job{
+		Owner:    claims.Username,
+		ChatID:   incoming.ChatID,
+		Query:    incoming.Query,
+		Params:   incoming.SamplingParams,
+		Priority: priority,
 	}
-
-	if err := conn.WriteMessage(websocket.TextMessage, []byte("[END]")); err != nil {
-		log.Printf("[WebSocket Write Error] %v for query: %s", err, incoming.Query)
+	if err := jobQueue.Enqueue(job); err != nil {
+		var overloaded *OverloadedError
+		if errors.As(err, &overloaded) {
+			reply.overloaded(overloaded)
+			return
+		}
+		log.Printf("[Jobs] Failed to enqueue job for %s: %v", claims.Username, err)
+		reply.error(wsproto.CodeInternal, "Failed to queue request")
 		return
 	}
+	log.Printf("[Jobs] Queued job %s for %s: %s", job.ID.Hex(), claims.Username, job.Query)
 
-	log.Printf("[WebSocket] Completed sending simulated tokens for query: %s", incoming.Query)
-
-	interaction := ChatInteraction{
-		ChatID:    incoming.ChatID,
-		UserChat:  incoming.Query,
-		ModelChat: modelResponse,
-	}
-	go AddInteraction(interaction)
-}*/
+	reply.jobQueued(job)
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GeorgeMichailov/personalllmchat/go-server/fakemodel"
+	"github.com/GeorgeMichailov/personalllmchat/go-server/wsproto"
+
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// TestMain points the collections at a MongoDB that is not there, so chat
+// writes fail quickly, as they would with the database down, instead of
+// dereferencing nil collections.
+func TestMain(m *testing.M) {
+	client, err := mongo.Connect(context.Background(), options.Client().
+		ApplyURI("mongodb://127.0.0.1:1").
+		SetServerSelectionTimeout(100*time.Millisecond))
+	if err != nil {
+		log.Fatal(err)
+	}
+	mongoClient = client
+	UserCollection = client.Database(databaseName).Collection(userCollectionName)
+	ChatCollection = client.Database(databaseName).Collection(chatCollectionName)
+	JobCollection = client.Database(databaseName).Collection(jobCollectionName)
+	os.Exit(m.Run())
+}
+
+// startFakeQueue points rqManager at a new queue that dispatches to an
+// in-process fake model, for the duration of the test.
+func startFakeQueue(t testing.TB, cfg fakemodel.Config) *RequestQueueManager {
+	t.Helper()
+	return startFakeQueueWith(t, cfg, (*RequestQueueManager).dispatchLoop)
+}
+
+// startFakeQueueWith is startFakeQueue with another scheduler loop.
+func startFakeQueueWith(t testing.TB, cfg fakemodel.Config, loop func(*RequestQueueManager, context.Context)) *RequestQueueManager {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	addr, err := fakemodel.Start(ctx, "127.0.0.1:0", cfg)
+	if err != nil {
+		cancel()
+		t.Fatalf("starting fake model: %v", err)
+	}
+
+	rqm := createRequestQueueManager()
+	rqm.backend = createBackendPool(addr, 1)
+	rqm.backend.onReady = rqm.wake
+	if err := rqm.backend.Start(ctx); err != nil {
+		cancel()
+		t.Fatalf("starting backend pool: %v", err)
+	}
+	context.AfterFunc(ctx, rqm.wake)
+	go loop(rqm, ctx)
+
+	prev := rqManager
+	rqManager = rqm
+	t.Cleanup(func() {
+		// Handlers still finishing up read rqManager.
+		rqm.consumers.Wait()
+		cancel()
+		rqManager = prev
+	})
+	return rqm
+}
+
+// usage returns the slots and tokens held by active requests.
+func (rqm *RequestQueueManager) usage() (queries, tokens int) {
+	rqm.mu.Lock()
+	defer rqm.mu.Unlock()
+	return rqm.activeQueries, rqm.activeTokens
+}
+
+// waitFor polls cond until it holds or timeout passes.
+func waitFor(t testing.TB, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out after %v waiting for %s", timeout, what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// dialWS opens a WebSocket to a test server running wsHandler as username.
+func dialWS(t *testing.T, srv *httptest.Server, username, query string, subprotocols ...string) *websocket.Conn {
+	t.Helper()
+	token, err := GenerateJWT(username, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer := websocket.Dialer{Subprotocols: subprotocols}
+	header := http.Header{"Authorization": {"Bearer " + token}}
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws" + query
+	conn, _, err := dialer.Dial(url, header)
+	if err != nil {
+		t.Fatalf("dialing %s: %v", url, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func newWSServer(t *testing.T) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(wsHandler))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// A client that drops its connection must give back its queue slot and token
+// budget right away, not when grpcQueryTimeout runs out.
+func TestDisconnectFreesSlot(t *testing.T) {
+	tests := []struct {
+		name       string
+		cfg        fakemodel.Config
+		readTokens int // read before dropping the connection
+	}{
+		{"hanging model", fakemodel.Config{HangRate: 1}, 0},
+		{"mid-stream", fakemodel.Config{Script: strings.Split(strings.Repeat("tok ", 1000), " "), TokenDelay: 10 * time.Millisecond}, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rqm := startFakeQueue(t, tt.cfg)
+			srv := newWSServer(t)
+
+			conn := dialWS(t, srv, "alice", "")
+			msg := map[string]any{"query": "tell me a long story", "chatid": primitive.NewObjectID().Hex()}
+			if err := conn.WriteJSON(msg); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < tt.readTokens; i++ {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					t.Fatalf("reading token %d: %v", i, err)
+				}
+			}
+			waitFor(t, 5*time.Second, "the request to be dispatched", func() bool {
+				queries, _ := rqm.usage()
+				return queries == 1
+			})
+
+			// Drop the TCP connection without a close frame, as a lost tab does.
+			conn.UnderlyingConn().Close()
+
+			waitFor(t, time.Second, "the slot to be released", func() bool {
+				queries, tokens := rqm.usage()
+				return queries == 0 && tokens == 0
+			})
+		})
+	}
+}
+
+// A refused query must not create a chat. The test has no MongoDB, so
+// creating one would fail the query with an internal error instead.
+func TestRefusedQueryCreatesNoChat(t *testing.T) {
+	defer func(prev int) { maxPendingPerUser = prev }(maxPendingPerUser)
+	maxPendingPerUser = 0 // refuse everything
+
+	startFakeQueue(t, fakemodel.Config{})
+	conn := dialWS(t, newWSServer(t), "alice", "")
+	if err := conn.WriteJSON(map[string]any{"query": "hello"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var reply map[string]any
+	if err := conn.ReadJSON(&reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply["code"] != "overloaded" {
+		t.Errorf("got %v, want an overloaded error", reply)
+	}
+}
+
+// A query stopped before it was started, as one queued behind another on an
+// untyped session can be, ends as stopped without a chat being created for
+// it. The test has no MongoDB, so creating one would fail the query instead.
+func TestStoppedBeforeStartCreatesNoChat(t *testing.T) {
+	startFakeQueue(t, fakemodel.Config{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conn := &wsConn{Conn: ws, typed: true}
+		defer conn.Close()
+
+		ctx, cancel := context.WithCancelCause(context.Background())
+		cancel(errStoppedByUser)
+		serveQuery(ctx, newReply(conn, "r1"), &Claims{Username: "alice"}, &IncomingWSMessage{Query: "never mind"})
+	}))
+	t.Cleanup(srv.Close)
+
+	dialer := websocket.Dialer{Subprotocols: []string{wsproto.Subprotocol}}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var frame wsproto.Frame
+	if err := conn.ReadJSON(&frame); err != nil {
+		t.Fatal(err)
+	}
+	var done wsproto.Done
+	if err := json.Unmarshal(frame.Payload, &done); err != nil {
+		t.Fatal(err)
+	}
+	if frame.Type != wsproto.TypeDone || done.FinishReason != wsproto.FinishStopped {
+		t.Errorf("got %s %s, want the answer done as stopped", frame.Type, frame.Payload)
+	}
+}
+
+// Stop sequences share the "stop" key with nothing else, so a query carrying
+// them is read and they reach the model, untyped and typed.
+func TestStopSequencesReachModel(t *testing.T) {
+	startFakeQueue(t, fakemodel.Config{Script: []string{"one", " two", "\n", "three"}})
+	srv := newWSServer(t)
+	query := map[string]any{"query": "lines", "chatid": primitive.NewObjectID().Hex(), "stop": []string{"\n"}}
+
+	t.Run("untyped", func(t *testing.T) {
+		conn := dialWS(t, srv, "alice", "")
+		if err := conn.WriteJSON(query); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatalf("reading after %q: %v", got, err)
+			}
+			if string(msg) == "[END]" {
+				break
+			}
+			got = append(got, string(msg))
+		}
+		if text := strings.Join(got, ""); text != "one two" {
+			t.Errorf("got %q, want the answer cut at the stop sequence", got)
+		}
+	})
+
+	t.Run("typed", func(t *testing.T) {
+		conn := dialWS(t, srv, "alice", "", wsproto.Subprotocol)
+		writeFrame(t, conn, wsproto.TypeQuery, primitive.NewObjectID().Hex(), query)
+		var text strings.Builder
+		for {
+			var token wsproto.Token
+			frame := readFrame(t, conn, nil)
+			if frame.Type == wsproto.TypeStatus {
+				continue
+			}
+			if frame.Type != wsproto.TypeToken {
+				if frame.Type != wsproto.TypeDone {
+					t.Fatalf("answer ended with a %s frame %s", frame.Type, frame.Payload)
+				}
+				break
+			}
+			if err := json.Unmarshal(frame.Payload, &token); err != nil {
+				t.Fatal(err)
+			}
+			text.WriteString(token.Text)
+		}
+		if text.String() != "one two" {
+			t.Errorf("got %q, want the answer cut at the stop sequence", text.String())
+		}
+	})
+}
+
+// chatWrites records the chat writes made while answering queries, in place
+// of MongoDB. Only the chats in owners exist already; set them before the
+// first query.
+type chatWrites struct {
+	owners       map[string]string // chat id to owner
+	created      chan string
+	deleted      chan string
+	interactions chan ChatInteraction
+}
+
+// fakeChatWrites records chat writes until the test ends. Call it before
+// startFakeQueue, so the writes are restored after the handlers are done.
+func fakeChatWrites(t *testing.T) *chatWrites {
+	// Earlier tests may still be saving in the background.
+	pendingInteractions.Wait()
+	w := &chatWrites{
+		owners:       make(map[string]string),
+		created:      make(chan string, 10),
+		deleted:      make(chan string, 10),
+		interactions: make(chan ChatInteraction, 10),
+	}
+	prevOwned, prevCreate, prevDelete, prevAdd := chatOwnedBy, createUserChat, deleteUserChat, addInteraction
+	chatOwnedBy = func(chatID, username string) (bool, error) { return w.owners[chatID] == username, nil }
+	createUserChat = func(string) (bool, primitive.ObjectID) {
+		id := primitive.NewObjectID()
+		w.created <- id.Hex()
+		return true, id
+	}
+	deleteUserChat = func(_, chatID string) { w.deleted <- chatID }
+	addInteraction = func(interaction ChatInteraction) { w.interactions <- interaction }
+	t.Cleanup(func() {
+		pendingInteractions.Wait()
+		chatOwnedBy, createUserChat, deleteUserChat, addInteraction = prevOwned, prevCreate, prevDelete, prevAdd
+	})
+	return w
+}
+
+// A stopped answer ends normally and the part the user was sent is kept in
+// the chat, marked as stopped.
+func TestStopKeepsPartialAnswer(t *testing.T) {
+	writes := fakeChatWrites(t)
+	startFakeQueue(t, fakemodel.Config{Script: slices.Repeat([]string{"tok "}, 100), TokenDelay: 10 * time.Millisecond})
+	conn := dialWS(t, newWSServer(t), "alice", "")
+
+	chatID := primitive.NewObjectID().Hex()
+	if err := conn.WriteJSON(map[string]any{"query": "go on", "chatid": chatID}); err != nil {
+		t.Fatal(err)
+	}
+	var sent strings.Builder
+	for i := 0; i < 3; i++ {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sent.Write(msg)
+	}
+	if err := conn.WriteJSON(map[string]any{"stop_generating": true}); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("reading after %q: %v", sent.String(), err)
+		}
+		if string(msg) == "[END]" {
+			break
+		}
+		sent.Write(msg)
+	}
+
+	select {
+	case got := <-writes.interactions:
+		want := ChatInteraction{ChatID: chatID, UserChat: "go on", ModelChat: sent.String(), FinishReason: wsproto.FinishStopped}
+		if got != want {
+			t.Errorf("saved %+v, want %+v", got, want)
+		}
+		if n := strings.Count(got.ModelChat, "tok"); n >= 100 {
+			t.Errorf("saved all %d tokens, want the answer cut short", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the stopped answer was not saved")
+	}
+}
+
+// A query stopped while the model has yet to send anything leaves no empty
+// chat behind.
+func TestStopBeforeFirstTokenDeletesChat(t *testing.T) {
+	writes := fakeChatWrites(t)
+	rqm := startFakeQueue(t, fakemodel.Config{HangRate: 1})
+	conn := dialWS(t, newWSServer(t), "alice", "", wsproto.Subprotocol)
+
+	requestID := primitive.NewObjectID().Hex()
+	writeFrame(t, conn, wsproto.TypeQuery, requestID, map[string]any{"query": "hang"})
+	var status wsproto.Status
+	if frame := readFrame(t, conn, &status); frame.Type != wsproto.TypeStatus || status.ChatID == "" {
+		t.Fatalf("got %s %s, want the accepted status with a new chat", frame.Type, frame.Payload)
+	}
+	waitFor(t, 5*time.Second, "the request to be dispatched", func() bool {
+		queries, _ := rqm.usage()
+		return queries == 1
+	})
+
+	writeFrame(t, conn, wsproto.TypeStop, requestID, nil)
+	var done wsproto.Done
+	if frame := readFrame(t, conn, &done); frame.Type != wsproto.TypeDone || done.FinishReason != wsproto.FinishStopped {
+		t.Fatalf("got %s %s, want the answer done as stopped", frame.Type, frame.Payload)
+	}
+	select {
+	case deleted := <-writes.deleted:
+		if deleted != status.ChatID {
+			t.Errorf("deleted chat %s, want %s", deleted, status.ChatID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the empty chat was not deleted")
+	}
+	if n := len(writes.interactions); n != 0 {
+		t.Errorf("%d interactions saved for an empty answer", n)
+	}
+}
+
+// An async query that cannot become a job is refused before a chat is made
+// for it, and is never told it was accepted.
+func TestRefusedAsyncCreatesNoChat(t *testing.T) {
+	defer func(prev *JobQueue) { jobQueue = prev }(jobQueue)
+	jobQueue = nil // jobs are switched off
+
+	writes := fakeChatWrites(t)
+	startFakeQueue(t, fakemodel.Config{})
+	conn := dialWS(t, newWSServer(t), "alice", "", wsproto.Subprotocol)
+
+	writeFrame(t, conn, wsproto.TypeQuery, primitive.NewObjectID().Hex(), map[string]any{"query": "later", "async": true})
+	var got wsproto.Error
+	if frame := readFrame(t, conn, &got); frame.Type != wsproto.TypeError || got.Code != wsproto.CodeNotEnabled {
+		t.Errorf("got %s %s, want a not_enabled error first", frame.Type, frame.Payload)
+	}
+	if n := len(writes.created); n != 0 {
+		t.Errorf("%d chats created for a refused query", n)
+	}
+}
@@ -14,10 +14,13 @@ const (
 	databaseName       = "playground1"
 	userCollectionName = "users"
 	chatCollectionName = "chats"
+	jobCollectionName  = "jobs"
 )
 
+var mongoClient *mongo.Client
 var UserCollection *mongo.Collection
 var ChatCollection *mongo.Collection
+var JobCollection *mongo.Collection
 
 func connectToMongoDB() {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
@@ -29,7 +32,15 @@ func connectToMongoDB() {
 		log.Fatal("Error connecting to MongoDB:", err)
 	}
 
+	mongoClient = client
 	UserCollection = client.Database(databaseName).Collection(userCollectionName)
 	ChatCollection = client.Database(databaseName).Collection(chatCollectionName)
+	JobCollection = client.Database(databaseName).Collection(jobCollectionName)
 
 }
+
+func disconnectFromMongoDB(ctx context.Context) {
+	if err := mongoClient.Disconnect(ctx); err != nil {
+		log.Printf("Error disconnecting from MongoDB: %v", err)
+	}
+}
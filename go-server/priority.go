@@ -0,0 +1,159 @@
+package main
+
+import "fmt"
+
+type Priority int
+
+const (
+	PriorityBatch Priority = iota
+	PriorityInteractive
+	PriorityAdmin
+	numPriorities
+)
+
+var priorityNames = [...]string{
+	PriorityBatch:       "batch",
+	PriorityInteractive: "interactive",
+	PriorityAdmin:       "admin",
+}
+
+func (p Priority) String() string {
+	if p >= 0 && p < numPriorities {
+		return priorityNames[p]
+	}
+	return "unknown"
+}
+
+func (p Priority) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+// Minimum share for lower classes: a class with queued work is served at
+// least once after this many dispatches went to higher classes.
+var priorityStarvationLimit = [numPriorities]int{
+	PriorityBatch:       envInt("LLM_BATCH_STARVATION_LIMIT", 9),
+	PriorityInteractive: envInt("LLM_INTERACTIVE_STARVATION_LIMIT", 4),
+}
+
+const roleAdmin = "admin"
+
+// resolvePriority picks the class for a request from the caller's role and the
+// class the request asks for. Anyone may ask for a lower class than their
+// default; only admins may ask for admin. The server issues no API keys, only
+// user tokens, so there is no key scope to take into account yet.
+func resolvePriority(requested string, claims *Claims) (Priority, error) {
+	isAdmin := claims.Role == roleAdmin
+
+	switch requested {
+	case "":
+		if isAdmin {
+			return PriorityAdmin, nil
+		}
+		return PriorityInteractive, nil
+	case "interactive":
+		return PriorityInteractive, nil
+	case "batch":
+		return PriorityBatch, nil
+	case "admin":
+		if !isAdmin {
+			return 0, fmt.Errorf("admin priority requires the admin role")
+		}
+		return PriorityAdmin, nil
+	}
+	return 0, fmt.Errorf("unknown priority %q", requested)
+}
+
+// priorityQueue serves higher classes first, except that a lower class which
+// has been passed over priorityStarvationLimit times gets the next turn.
+// Within a class users take turns through a fairQueue.
+type priorityQueue struct {
+	classes [numPriorities]*fairQueue
+	skipped [numPriorities]int
+}
+
+func newPriorityQueue() *priorityQueue {
+	pq := &priorityQueue{}
+	for p := range pq.classes {
+		pq.classes[p] = newFairQueue()
+	}
+	return pq
+}
+
+func (pq *priorityQueue) Len() int {
+	n := 0
+	for _, fq := range pq.classes {
+		n += fq.Len()
+	}
+	return n
+}
+
+func (pq *priorityQueue) LenByPriority() map[Priority]int {
+	counts := make(map[Priority]int, numPriorities)
+	for p, fq := range pq.classes {
+		counts[Priority(p)] = fq.Len()
+	}
+	return counts
+}
+
+// userLen counts username's queued requests across all classes.
+func (pq *priorityQueue) userLen(username string) int {
+	n := 0
+	for _, fq := range pq.classes {
+		n += len(fq.users[username])
+	}
+	return n
+}
+
+// clone returns a copy of pq that can be popped without changing pq.
+func (pq *priorityQueue) clone() *priorityQueue {
+	c := &priorityQueue{skipped: pq.skipped}
+	for p, fq := range pq.classes {
+		c.classes[p] = fq.clone()
+	}
+	return c
+}
+
+// each calls fn for every queued request, highest class first. That is not
+// the order they are dispatched in, see RequestQueueManager.dispatchOrder.
+func (pq *priorityQueue) each(fn func(*Request)) {
+	for p := numPriorities - 1; p >= PriorityBatch; p-- {
+		pq.classes[p].each(fn)
+	}
+}
+
+func (pq *priorityQueue) push(req *Request) {
+	pq.classes[req.priority].push(req)
+}
+
+func (pq *priorityQueue) remove(req *Request) bool {
+	return pq.classes[req.priority].remove(req)
+}
+
+func (pq *priorityQueue) pop(eligible func(*Request) bool) *Request {
+	// A starved lower class goes first.
+	for p := PriorityBatch; p < numPriorities; p++ {
+		limit := priorityStarvationLimit[p]
+		if limit == 0 || pq.skipped[p] < limit {
+			continue
+		}
+		if req := pq.classes[p].pop(eligible); req != nil {
+			pq.skipped[p] = 0
+			return req
+		}
+	}
+
+	for p := numPriorities - 1; p >= PriorityBatch; p-- {
+		req := pq.classes[p].pop(eligible)
+		if req == nil {
+			continue
+		}
+		pq.skipped[p] = 0
+		for lower := PriorityBatch; lower < p; lower++ {
+			if pq.classes[lower].Len() > 0 {
+				pq.skipped[lower]++
+			}
+		}
+		return req
+	}
+	return nil
+}
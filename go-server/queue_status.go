@@ -0,0 +1,99 @@
+package main
+
+import (
+	"maps"
+	"time"
+)
+
+// QueueStatus is pushed to clients that asked for status updates, so they can
+// show their place in line instead of a spinner.
+type QueueStatus struct {
+	RequestID    string `json:"request_id,omitempty"` // set in sessions, see wsReply
+	Status       string `json:"status"`               // queued, dispatched, first_token, completed, expired
+	Position     int    `json:"position,omitempty"`
+	EtaMs        int64  `json:"eta_ms,omitempty"`
+	FinishReason string `json:"finish_reason,omitempty"`
+	Cached       bool   `json:"cached,omitempty"` // completed from the response cache
+}
+
+// Weight of the newest sample in the moving average of generation time.
+const serviceTimeSmoothing = 0.2
+
+// publishStatus hands st to the client without ever blocking the queue. Only
+// the latest status matters, so an unread older one is replaced.
+func (req *Request) publishStatus(st QueueStatus) {
+	if req.statusCh == nil {
+		return
+	}
+	select {
+	case <-req.statusCh:
+	default:
+	}
+	select {
+	case req.statusCh <- st:
+	default:
+	}
+}
+
+// recordServiceTime folds a finished generation's duration into the average
+// used for wait estimates. Must be called with rqm.mu held.
+func (rqm *RequestQueueManager) recordServiceTime(d time.Duration) {
+	if rqm.avgServiceTime == 0 {
+		rqm.avgServiceTime = d
+		return
+	}
+	rqm.avgServiceTime += time.Duration(serviceTimeSmoothing * float64(d-rqm.avgServiceTime))
+}
+
+// estimateWait guesses how long the request at the given 1-based position will
+// wait, assuming slots free up at the recent average rate. Zero means unknown.
+// Must be called with rqm.mu held.
+func (rqm *RequestQueueManager) estimateWait(position int) time.Duration {
+	if rqm.avgServiceTime == 0 {
+		return 0
+	}
+	return rqm.avgServiceTime * time.Duration(position) / time.Duration(rqm.limiter.Limit())
+}
+
+// dispatchOrder lists the queued requests in the order nextDispatch would
+// pick them if nothing arrived or finished meanwhile: by class with the
+// starvation shares, and within a class taking turns between users from where
+// the last dispatch left off, holding back users at maxActivePerUser until
+// everyone else has had a turn. The token budget is left out, since whether a
+// request fits depends on which active ones finish first. Must be called with
+// rqm.mu held.
+func (rqm *RequestQueueManager) dispatchOrder() []*Request {
+	sim := rqm.queue.clone()
+	active := maps.Clone(rqm.activeByUser)
+	underCap := func(req *Request) bool { return active[req.username] < maxActivePerUser }
+	anyone := func(*Request) bool { return true }
+
+	order := make([]*Request, 0, sim.Len())
+	for sim.Len() > 0 {
+		req := sim.pop(underCap)
+		if req == nil {
+			// Only users at their cap are left; one of their slots frees up.
+			req = sim.pop(anyone)
+		}
+		active[req.username]++
+		order = append(order, req)
+	}
+	return order
+}
+
+// publishPositions tells every queued request whose place in line changed
+// where it now stands. Must be called with rqm.mu held.
+func (rqm *RequestQueueManager) publishPositions() {
+	for i, req := range rqm.dispatchOrder() {
+		position := i + 1
+		if req.statusCh == nil || req.lastPosition == position {
+			continue
+		}
+		req.lastPosition = position
+		req.publishStatus(QueueStatus{
+			Status:   "queued",
+			Position: position,
+			EtaMs:    rqm.estimateWait(position).Milliseconds(),
+		})
+	}
+}
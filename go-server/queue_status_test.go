@@ -0,0 +1,55 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+// Positions follow the dispatcher: the round-robin cursor, per-user caps and
+// lower classes getting a turn, rather than the order requests are stored in.
+func TestDispatchOrder(t *testing.T) {
+	defer func(prev int) { maxActivePerUser = prev }(maxActivePerUser)
+	maxActivePerUser = 2
+
+	rqm := createRequestQueueManager()
+	rqm.activeByUser["carol"] = 2 // all of carol's slots are taken
+
+	queued := map[string]*Request{}
+	push := func(name, username string, priority Priority) {
+		req := newTestRequest(username, name)
+		req.priority = priority
+		queued[name] = req
+		rqm.queue.push(req)
+	}
+	push("a1", "alice", PriorityInteractive)
+	push("a2", "alice", PriorityInteractive)
+	push("a3", "alice", PriorityInteractive)
+	push("b1", "bob", PriorityInteractive)
+	push("c1", "carol", PriorityInteractive)
+	push("d1", "dave", PriorityBatch)
+
+	// Dispatch a1 so the cursor has moved on to bob.
+	if req := rqm.queue.pop(func(*Request) bool { return true }); req != queued["a1"] {
+		t.Fatalf("popped %s, want a1", req.query)
+	}
+	rqm.activeByUser["alice"]++
+
+	var got []string
+	for _, req := range rqm.dispatchOrder() {
+		got = append(got, req.query)
+	}
+	// bob is next in turn; carol is at the cap and so is alice after a2, which
+	// lets dave's batch request through before either of them.
+	want := []string{"b1", "a2", "d1", "c1", "a3"}
+	if !slices.Equal(got, want) {
+		t.Errorf("dispatch order %v, want %v", got, want)
+	}
+
+	// Working out the order must not change the queue.
+	if n := rqm.queue.Len(); n != len(want) {
+		t.Errorf("queue holds %d requests after dispatchOrder, want %d", n, len(want))
+	}
+	if got := rqm.dispatchOrder()[0].query; got != "b1" {
+		t.Errorf("second dispatchOrder starts with %s, want b1", got)
+	}
+}
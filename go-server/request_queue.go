@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pb "github.com/GeorgeMichailov/personalllmchat/go-server/model-service"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const gracePeriod = 5 * time.Second
+
+// Upper bound on how many of the active query slots one user may hold.
+var maxActivePerUser = envInt("LLM_MAX_ACTIVE_PER_USER", 2)
+
+type Request struct {
+	id         string
+	query      string
+	username   string
+	priority   Priority
+	ctx        context.Context         // cancelled once nobody is waiting for the answer
+	cancel     context.CancelCauseFunc // the cause tells the consumer who cancelled
+	responseCh chan *pb.QueryResponse
+	createdAt  time.Time
+	maxWait    time.Duration // how long it may stay queued; gracePeriod if zero
+	ChatID     string
+	params     *pb.SamplingParams
+	tokens     int    // estimated prompt plus completion tokens, see estimateTokens
+	cacheKey   string // set if the completed response goes into responseCache
+
+	coalesceKey string      // set if identical requests may share this one's generation
+	gen         *generation // set while this request leads a shared generation
+
+	statusCh     chan QueueStatus // nil unless the client wants status updates
+	lastPosition int
+	dispatchedAt time.Time
+	backend      string // connection the request was dispatched on
+
+	// Written by the interactor only, read once it has returned.
+	firstTokenAt time.Time
+	lastTokenAt  time.Time
+	tokenCount   atomic.Int32 // also read live for introspection
+
+	expiry     *time.Timer   // fires if the request is still queued after maxWait
+	expiresAt  time.Time     // when expiry fires, unless dispatching is paused
+	expiryLeft time.Duration // what was left of gracePeriod when dispatching was paused
+	stopCancel func() bool   // stops watching ctx once the request has left the queue
+
+	stateMu sync.Mutex
+	state   RequestState // only changed through transition
+}
+
+// send delivers an event unless the request has been cancelled, so the
+// interactor never blocks on a consumer that has gone away.
+func (req *Request) send(resp *pb.QueryResponse) bool {
+	select {
+	case req.responseCh <- resp:
+		return true
+	case <-req.ctx.Done():
+		return false
+	}
+}
+
+// emit delivers an event from the model to req and to any requests
+// following it.
+func (req *Request) emit(resp *pb.QueryResponse) bool {
+	if req.gen != nil {
+		req.gen.publish(resp)
+	}
+	return req.send(resp)
+}
+
+// RequestQueueManager dispatches queued requests to the model backend as soon
+// as a slot is free and the request fits in the token budget, by priority
+// class and then taking turns between users. The dispatcher sleeps on cond
+// and is woken by every event that can make a request dispatchable: a new
+// request, a released slot, the backend becoming ready, or shutdown.
+type RequestQueueManager struct {
+	queue          *priorityQueue
+	active         map[*Request]struct{}
+	activeQueries  int
+	activeTokens   int                 // sum of tokens over active requests
+	limiter        *concurrencyLimiter // decides how many queries may be active
+	activeByUser   map[string]int
+	avgServiceTime time.Duration       // moving average of dispatch-to-finish time
+	generations    map[string]*Request // leaders of shared generations by coalesceKey
+	coalesced      int                 // requests served by following a leader
+	backend        *BackendPool
+	paused         bool           // set by Pause; nothing is dispatched until Resume
+	draining       bool           // set by Drain; no new requests are accepted
+	consumers      sync.WaitGroup // accepted requests whose consumer has not called Finish
+	mu             sync.Mutex
+	cond           *sync.Cond
+}
+
+func createRequestQueueManager() *RequestQueueManager {
+	rqm := &RequestQueueManager{
+		queue:         newPriorityQueue(),
+		active:        make(map[*Request]struct{}),
+		limiter:       newConcurrencyLimiter(),
+		activeQueries: 0,
+		activeByUser:  make(map[string]int),
+		generations:   make(map[string]*Request),
+		backend:       createBackendPool(modelServiceAddr, backendPoolSize),
+	}
+	rqm.cond = sync.NewCond(&rqm.mu)
+	rqm.backend.onReady = rqm.wake
+	return rqm
+}
+
+var rqManager *RequestQueueManager = createRequestQueueManager()
+
+// AddRequest queues req, or refuses it with an *OverloadedError when the
+// queue or the user's share of it is full, or errShuttingDown once draining.
+// Whoever consumes an accepted request must call Finish when done with it.
+func (rqm *RequestQueueManager) AddRequest(req *Request) error {
+	req.id = primitive.NewObjectID().Hex()
+	req.tokens = estimateTokens(req.query, req.params)
+	req.coalesceKey = coalesceKey(req.query, req.params)
+
+	rqm.mu.Lock()
+	if rqm.draining {
+		rqm.mu.Unlock()
+		return errShuttingDown
+	}
+	// An identical request is already running; share it instead of queueing.
+	if leader := rqm.leaderFor(req); leader != nil && rqm.follow(leader, req) {
+		rqm.consumers.Add(1)
+		rqm.mu.Unlock()
+		return nil
+	}
+	if err := rqm.admit(req); err != nil {
+		rqm.mu.Unlock()
+		log.Printf("[Queue Rejected] %v for %s: %s", err, req.username, req.query)
+		return err
+	}
+	log.Printf("[Queue] Adding new %s request %s from %s: %s", req.priority, req.id, req.username, req.query)
+	rqm.consumers.Add(1)
+	rqm.queue.push(req)
+	wait := gracePeriod
+	if req.maxWait > 0 {
+		wait = req.maxWait
+	}
+	req.expiresAt = time.Now().Add(wait)
+	req.expiry = time.AfterFunc(wait, func() { rqm.expire(req) })
+	if rqm.paused {
+		req.expiry.Stop()
+		req.expiryLeft = wait
+	}
+	req.stopCancel = context.AfterFunc(req.ctx, func() { rqm.cancelQueued(req) })
+	rqm.publishPositions()
+	rqm.mu.Unlock()
+	rqm.cond.Signal()
+	return nil
+}
+
+// CheckAdmission reports the error AddRequest would refuse req with if it
+// were added now, without adding it. AddRequest still has the final say.
+func (rqm *RequestQueueManager) CheckAdmission(req *Request) error {
+	req.tokens = estimateTokens(req.query, req.params)
+	req.coalesceKey = coalesceKey(req.query, req.params)
+
+	rqm.mu.Lock()
+	defer rqm.mu.Unlock()
+	if rqm.draining {
+		return errShuttingDown
+	}
+	if rqm.leaderFor(req) != nil {
+		return nil
+	}
+	return rqm.admit(req)
+}
+
+func (rqm *RequestQueueManager) Start(ctx context.Context) {
+	if err := rqm.backend.Start(ctx); err != nil {
+		log.Printf("[Backend] Failed to start connection pool: %v", err)
+	}
+
+	rqm.publishMetrics()
+	context.AfterFunc(ctx, rqm.wake)
+	go rqm.dispatchLoop(ctx)
+}
+
+// wake re-evaluates the queue. Taking the lock means a dispatcher that has just
+// found nothing to do is guaranteed to be waiting before the broadcast.
+func (rqm *RequestQueueManager) wake() {
+	rqm.mu.Lock()
+	rqm.cond.Broadcast()
+	rqm.mu.Unlock()
+}
+
+func (rqm *RequestQueueManager) dispatchLoop(ctx context.Context) {
+	rqm.mu.Lock()
+	defer rqm.mu.Unlock()
+
+	for {
+		client, backend, req := rqm.nextDispatch()
+		for ctx.Err() == nil && req == nil {
+			rqm.cond.Wait()
+			client, backend, req = rqm.nextDispatch()
+		}
+		if ctx.Err() != nil {
+			log.Printf("[Queue] Context done, stopping queue manager.")
+			return
+		}
+
+		rqm.dispatch(client, backend, req)
+	}
+}
+
+// dispatch starts req on client, which nextDispatch picked for it, and gives
+// its slot back once the interactor is done. Must be called with rqm.mu held.
+func (rqm *RequestQueueManager) dispatch(client pb.VLLMServiceClient, backend string, req *Request) {
+	req.expiry.Stop()
+	req.stopCancel()
+	if !req.transition(StateDispatched) {
+		return
+	}
+
+	log.Printf("[Dispatch] Dispatching %s query from %s: %s (waited %v)", req.priority, req.username, req.query, time.Since(req.createdAt))
+	req.dispatchedAt = time.Now()
+	req.backend = backend
+	if req.coalesceKey != "" {
+		rqm.lead(req)
+	}
+	req.publishStatus(QueueStatus{Status: "dispatched"})
+	rqm.publishPositions()
+	rqm.active[req] = struct{}{}
+	rqm.activeQueries++
+	rqm.activeTokens += req.tokens
+	rqm.activeByUser[req.username]++
+	go func(r *Request) {
+		vLlmInteractor(client, r)
+		rqm.mu.Lock()
+		delete(rqm.active, r)
+		if r.gen != nil {
+			rqm.endGeneration(r)
+		}
+		rqm.observeLatency(r)
+		rqm.activeQueries--
+		rqm.activeTokens -= r.tokens
+		if rqm.activeByUser[r.username]--; rqm.activeByUser[r.username] == 0 {
+			delete(rqm.activeByUser, r.username)
+		}
+		rqm.cond.Signal()
+		rqm.mu.Unlock()
+	}(req)
+}
+
+// observeLatency feeds a finished request into the wait estimate and the
+// concurrency limiter. Cancelled requests say nothing about backend health and
+// are skipped. Must be called with rqm.mu held.
+func (rqm *RequestQueueManager) observeLatency(req *Request) {
+	switch req.State() {
+	case StateCompleted:
+		rqm.recordServiceTime(time.Since(req.dispatchedAt))
+		tokens := req.tokenCount.Load()
+		if tokens == 0 {
+			return
+		}
+		var interToken time.Duration
+		if tokens > 1 {
+			interToken = req.lastTokenAt.Sub(req.firstTokenAt) / time.Duration(tokens-1)
+		}
+		rqm.limiter.observe(req.firstTokenAt.Sub(req.dispatchedAt), interToken, false, rqm.activeQueries)
+	case StateFailed:
+		rqm.limiter.observe(0, 0, true, rqm.activeQueries)
+	}
+}
+
+// nextDispatch picks the next request to run and a backend client for it, or
+// returns a nil request if nothing can be dispatched right now. Must be called
+// with rqm.mu held.
+func (rqm *RequestQueueManager) nextDispatch() (pb.VLLMServiceClient, string, *Request) {
+	if rqm.paused || rqm.queue.Len() == 0 || rqm.activeQueries >= rqm.limiter.Limit() {
+		return nil, "", nil
+	}
+	client, backend, err := rqm.backend.Client()
+	if err != nil {
+		// onReady wakes the dispatcher once the backend is back.
+		return nil, "", nil
+	}
+	req := rqm.queue.pop(func(req *Request) bool {
+		return rqm.activeByUser[req.username] < maxActivePerUser && rqm.fitsTokenBudget(req)
+	})
+	return client, backend, req
+}
+
+func (rqm *RequestQueueManager) expire(req *Request) {
+	rqm.mu.Lock()
+	defer rqm.mu.Unlock()
+	if !rqm.queue.remove(req) {
+		return
+	}
+	req.stopCancel()
+	log.Printf("[Queue Timeout] Request expired for query: %s", req.query)
+	req.transition(StateExpired)
+	rqm.publishPositions()
+}
+
+func (rqm *RequestQueueManager) cancelQueued(req *Request) {
+	rqm.mu.Lock()
+	defer rqm.mu.Unlock()
+	if !rqm.queue.remove(req) {
+		return
+	}
+	req.expiry.Stop()
+	log.Printf("[Queue Cancel] Request cancelled for query: %s", req.query)
+	req.transition(StateCancelled)
+	rqm.publishPositions()
+}
+
+// RequestInfo describes a queued or active request for introspection.
+type RequestInfo struct {
+	ID              string   `json:"id"`
+	Username        string   `json:"username"`
+	ChatID          string   `json:"chatid"`
+	Priority        Priority `json:"priority"`
+	State           string   `json:"state"`
+	AgeMs           int64    `json:"age_ms"`
+	EstimatedTokens int      `json:"estimated_tokens"`
+	TokensStreamed  int32    `json:"tokens_streamed"`
+	Backend         string   `json:"backend,omitempty"`
+}
+
+// info must be called with rqm.mu held, which guards backend.
+func (req *Request) info(now time.Time) RequestInfo {
+	return RequestInfo{
+		ID:              req.id,
+		Username:        req.username,
+		ChatID:          req.ChatID,
+		Priority:        req.priority,
+		State:           req.State().String(),
+		AgeMs:           now.Sub(req.createdAt).Milliseconds(),
+		EstimatedTokens: req.tokens,
+		TokensStreamed:  req.tokenCount.Load(),
+		Backend:         req.backend,
+	}
+}
+
+// Snapshot lists queued requests in the order they would be dispatched, see
+// dispatchOrder, followed by active ones.
+func (rqm *RequestQueueManager) Snapshot() (queued []RequestInfo, active []RequestInfo) {
+	rqm.mu.Lock()
+	defer rqm.mu.Unlock()
+
+	now := time.Now()
+	order := rqm.dispatchOrder()
+	queued = make([]RequestInfo, 0, len(order))
+	for _, req := range order {
+		queued = append(queued, req.info(now))
+	}
+	active = make([]RequestInfo, 0, len(rqm.active))
+	for req := range rqm.active {
+		active = append(active, req.info(now))
+	}
+	return queued, active
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/GeorgeMichailov/personalllmchat/go-server/fakemodel"
+	pb "github.com/GeorgeMichailov/personalllmchat/go-server/model-service"
+)
+
+// newTestRequest returns an interactive request as serveQuery would build it.
+func newTestRequest(username, query string) *Request {
+	params, err := SamplingParams{}.Resolve(samplingLimits)
+	if err != nil {
+		panic(err)
+	}
+	ctx, cancel := context.WithCancelCause(context.Background())
+	return &Request{
+		query:      query,
+		username:   username,
+		priority:   PriorityInteractive,
+		ctx:        ctx,
+		cancel:     cancel,
+		responseCh: make(chan *pb.QueryResponse, 10),
+		createdAt:  time.Now(),
+		params:     params,
+	}
+}
+
+// drain reads req's events until the request ends, as a consumer does.
+func drain(req *Request) {
+	for range req.responseCh {
+	}
+}
+
+// scanLoop is the scheduler dispatchLoop replaced, kept for comparison: it
+// looks at the queue every interval and dispatches whatever fits then.
+func (rqm *RequestQueueManager) scanLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			rqm.mu.Lock()
+			for {
+				client, backend, req := rqm.nextDispatch()
+				if req == nil {
+					break
+				}
+				rqm.dispatch(client, backend, req)
+			}
+			rqm.mu.Unlock()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// dispatchBurst is how many requests arrive at once in BenchmarkDispatchLatency,
+// several times the initial concurrency limit so most of them have to queue.
+const dispatchBurst = 16
+
+// BenchmarkDispatchLatency measures the time from AddRequest to dispatch while
+// bursts of requests from different users compete for the active slots, for
+// dispatchLoop and for the 500ms ticker scan it replaced. Each iteration is one
+// burst; mean-ms and p99-ms are per request. Run it with
+//
+//	go test -run '^$' -bench DispatchLatency
+func BenchmarkDispatchLatency(b *testing.B) {
+	loops := []struct {
+		name string
+		run  func(*RequestQueueManager, context.Context)
+	}{
+		{"event-driven", (*RequestQueueManager).dispatchLoop},
+		{"ticker-500ms", func(rqm *RequestQueueManager, ctx context.Context) { rqm.scanLoop(ctx, 500*time.Millisecond) }},
+	}
+
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	for _, loop := range loops {
+		b.Run(loop.name, func(b *testing.B) {
+			rqm := startFakeQueueWith(b, fakemodel.Config{Script: []string{"ok"}}, loop.run)
+			waitFor(b, 5*time.Second, "the backend", rqm.backend.Ready)
+
+			var latencies []time.Duration
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				latencies = append(latencies, dispatchLatencies(b, rqm, dispatchBurst)...)
+			}
+			b.StopTimer()
+
+			slices.Sort(latencies)
+			var total time.Duration
+			for _, l := range latencies {
+				total += l
+			}
+			ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+			b.ReportMetric(ms(total/time.Duration(len(latencies))), "mean-ms")
+			b.ReportMetric(ms(latencies[len(latencies)*99/100]), "p99-ms")
+		})
+	}
+}
+
+// dispatchLatencies adds n requests at once, waits until all are answered and
+// returns how long each waited to be dispatched.
+func dispatchLatencies(b *testing.B, rqm *RequestQueueManager, n int) []time.Duration {
+	reqs := make([]*Request, n)
+	var wg sync.WaitGroup
+	for i := range reqs {
+		reqs[i] = newTestRequest(fmt.Sprintf("user%d", i), fmt.Sprintf("query %d", i))
+		wg.Add(1)
+		go func(req *Request) {
+			defer wg.Done()
+			if err := rqm.AddRequest(req); err != nil {
+				b.Error(err)
+				return
+			}
+			drain(req)
+			rqm.Finish()
+		}(reqs[i])
+	}
+	wg.Wait()
+
+	latencies := make([]time.Duration, 0, n)
+	for _, req := range reqs {
+		if req.State() != StateCompleted {
+			b.Fatalf("request ended %s, want completed", req.State())
+		}
+		latencies = append(latencies, req.dispatchedAt.Sub(req.createdAt))
+	}
+	return latencies
+}
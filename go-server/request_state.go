@@ -0,0 +1,85 @@
+package main
+
+import "log"
+
+type RequestState int
+
+const (
+	StateQueued RequestState = iota
+	StateDispatched
+	StateStreaming
+	StateCompleted
+	StateExpired
+	StateCancelled
+	StateFailed
+)
+
+var requestStateNames = [...]string{
+	StateQueued:     "queued",
+	StateDispatched: "dispatched",
+	StateStreaming:  "streaming",
+	StateCompleted:  "completed",
+	StateExpired:    "expired",
+	StateCancelled:  "cancelled",
+	StateFailed:     "failed",
+}
+
+func (s RequestState) String() string {
+	if int(s) < len(requestStateNames) {
+		return requestStateNames[s]
+	}
+	return "unknown"
+}
+
+func (s RequestState) Terminal() bool {
+	return s >= StateCompleted
+}
+
+// requestTransitions lists every legal move. Anything else is a bug and is
+// refused, which is what makes a second close of responseCh impossible.
+var requestTransitions = map[RequestState][]RequestState{
+	StateQueued:     {StateDispatched, StateExpired, StateCancelled},
+	StateDispatched: {StateStreaming, StateCompleted, StateCancelled, StateFailed},
+	StateStreaming:  {StateCompleted, StateCancelled, StateFailed},
+}
+
+func canTransition(from, to RequestState) bool {
+	for _, next := range requestTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// State returns the request's current lifecycle state.
+func (req *Request) State() RequestState {
+	req.stateMu.Lock()
+	defer req.stateMu.Unlock()
+	return req.state
+}
+
+// transition moves the request to state to if that is legal from its current
+// state and reports whether it did. Entering a terminal state closes
+// responseCh; since terminal states have no way out, that happens exactly once.
+//
+// While queued, the queue manager is the only writer of responseCh; once
+// dispatched, the interactor is. Each only closes the channel through here.
+func (req *Request) transition(to RequestState) bool {
+	req.stateMu.Lock()
+	defer req.stateMu.Unlock()
+
+	from := req.state
+	if !canTransition(from, to) {
+		if !from.Terminal() {
+			log.Printf("[Request] Refused transition %s -> %s for query: %s", from, to, req.query)
+		}
+		return false
+	}
+
+	req.state = to
+	if to.Terminal() {
+		close(req.responseCh)
+	}
+	return true
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/GeorgeMichailov/personalllmchat/go-server/fakemodel"
+)
+
+// Every goroutine races to end the same request; exactly one may win, and the
+// channel is closed by the winner only (a second close would panic).
+func TestTransitionClosesOnce(t *testing.T) {
+	moves := []RequestState{StateDispatched, StateStreaming, StateCompleted, StateExpired, StateCancelled, StateFailed}
+
+	for i := 0; i < 500; i++ {
+		req := newTestRequest("alice", "q")
+		var ended atomic.Int32
+		var wg sync.WaitGroup
+		for _, to := range moves {
+			for j := 0; j < 4; j++ {
+				wg.Add(1)
+				go func(to RequestState) {
+					defer wg.Done()
+					if req.transition(to) && to.Terminal() {
+						ended.Add(1)
+					}
+				}(to)
+			}
+		}
+		wg.Wait()
+
+		if n := ended.Load(); n != 1 {
+			t.Fatalf("request %d entered a terminal state %d times", i, n)
+		}
+		if !req.State().Terminal() {
+			t.Fatalf("request %d ended in %s", i, req.State())
+		}
+		if _, ok := <-req.responseCh; ok {
+			t.Fatalf("request %d: responseCh still open", i)
+		}
+	}
+}
+
+// Many requests go through the queue while expiry, the client going away, an
+// administrator and the interactor all try to end them at once. Each must end
+// exactly once, and the queue must give back everything it handed out.
+func TestConcurrentLifecycle(t *testing.T) {
+	rqm := startFakeQueue(t, fakemodel.Config{TokenDelay: time.Millisecond})
+	waitFor(t, 5*time.Second, "the backend", rqm.backend.Ready)
+
+	const rounds, perRound = 10, 24 // below maxQueueDepth so none is refused
+	endings := make(map[RequestState]int)
+	for round := 0; round < rounds; round++ {
+		reqs := make([]*Request, perRound)
+		var wg sync.WaitGroup
+		for i := range reqs {
+			req := newTestRequest(fmt.Sprintf("user%d", i), fmt.Sprintf("round %d query %d goes here", round, i))
+			reqs[i] = req
+			if err := rqm.AddRequest(req); err != nil {
+				t.Fatalf("AddRequest: %v", err)
+			}
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				drain(req)
+				rqm.Finish()
+			}()
+
+			// Each way of ending the request fires after a random delay, so
+			// they land while it is queued, streaming or already done.
+			delay := func() { time.Sleep(time.Duration(rand.Intn(3000)) * time.Microsecond) }
+			if rand.Intn(2) == 0 {
+				wg.Add(1)
+				go func() { defer wg.Done(); delay(); rqm.expire(req) }()
+			}
+			if rand.Intn(2) == 0 {
+				wg.Add(1)
+				go func() { defer wg.Done(); delay(); req.cancel(errClientGone) }()
+			}
+			if rand.Intn(2) == 0 {
+				wg.Add(1)
+				go func() { defer wg.Done(); delay(); rqm.Cancel(req.id) }()
+			}
+		}
+		wg.Wait()
+
+		for i, req := range reqs {
+			state := req.State()
+			if !state.Terminal() {
+				t.Fatalf("round %d request %d ended in %s", round, i, state)
+			}
+			endings[state]++
+		}
+	}
+	t.Logf("endings: %v", endings)
+	// The fake model never fails; a request cancelled as it was dispatched
+	// must not count as a backend failure, which would lower the limit.
+	if n := endings[StateFailed]; n != 0 {
+		t.Errorf("%d requests failed", n)
+	}
+
+	waitFor(t, time.Second, "all slots to be released", func() bool {
+		queries, tokens := rqm.usage()
+		return queries == 0 && tokens == 0
+	})
+	if n := rqm.queue.Len(); n != 0 {
+		t.Errorf("%d requests left in the queue", n)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/GeorgeMichailov/personalllmchat/go-server/model-service"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// Repeated prompts can be answered from a cache of earlier completions instead
+// of the model. Only deterministic requests are cached unless
+// LLM_CACHE_NONDETERMINISTIC is set, since anything else is expected to vary.
+
+var (
+	responseCacheEnabled  = envBool("LLM_RESPONSE_CACHE")
+	cacheNondeterministic = envBool("LLM_CACHE_NONDETERMINISTIC")
+	cacheTTL              = time.Duration(envInt("LLM_CACHE_TTL_S", 3600)) * time.Second
+	cacheMaxBytes         = envInt("LLM_CACHE_MAX_BYTES", 16<<20)
+	cacheReplayDelay      = time.Duration(envInt("LLM_CACHE_REPLAY_DELAY_MS", 15)) * time.Millisecond
+
+	// Identifies the weights served by the model service; part of responseKey
+	// so a model change never replays the old model's answers.
+	modelName = envString("LLM_MODEL_NAME", "merged_model")
+)
+
+// cachedResponse is a completed generation, kept token by token so a replay
+// streams like the original did.
+type cachedResponse struct {
+	key     string
+	tokens  []string
+	summary *pb.QuerySummary
+	expires time.Time
+	size    int
+}
+
+// ResponseCache is a size-bounded LRU of completed responses.
+type ResponseCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // front is most recently used
+	bytes   int
+
+	hits, misses, evictions int64
+}
+
+var responseCache = createResponseCache()
+
+func createResponseCache() *ResponseCache {
+	rc := &ResponseCache{
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+	expvar.Publish("response_cache", expvar.Func(func() any {
+		rc.mu.Lock()
+		defer rc.mu.Unlock()
+		return map[string]any{
+			"enabled":   responseCacheEnabled,
+			"entries":   rc.lru.Len(),
+			"bytes":     rc.bytes,
+			"hits":      rc.hits,
+			"misses":    rc.misses,
+			"evictions": rc.evictions,
+		}
+	}))
+	return rc
+}
+
+// deterministic reports whether params make the model's answer repeatable.
+func deterministic(params *pb.SamplingParams) bool {
+	return params.Temperature == 0 || params.Seed != nil
+}
+
+// responseKey identifies a query with resolved params: requests with the same
+// key get the same answer if they are deterministic.
+func responseKey(query string, params *pb.SamplingParams) string {
+	encoded, err := proto.MarshalOptions{Deterministic: true}.Marshal(params)
+	if err != nil {
+		return ""
+	}
+	h := sha256.New()
+	h.Write([]byte(modelName))
+	h.Write([]byte{0})
+	h.Write([]byte(strings.Join(strings.Fields(query), " ")))
+	h.Write([]byte{0})
+	h.Write(encoded)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// cacheKey returns the cache key for a query with resolved params, or "" if
+// the request must not be cached.
+func cacheKey(query string, params *pb.SamplingParams) string {
+	if !responseCacheEnabled || !(cacheNondeterministic || deterministic(params)) {
+		return ""
+	}
+	return responseKey(query, params)
+}
+
+// Lookup returns the live entry for key, or nil.
+func (rc *ResponseCache) Lookup(key string) *cachedResponse {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	elem, ok := rc.entries[key]
+	if ok && time.Now().After(elem.Value.(*cachedResponse).expires) {
+		rc.remove(elem)
+		ok = false
+	}
+	if !ok {
+		rc.misses++
+		return nil
+	}
+	rc.hits++
+	rc.lru.MoveToFront(elem)
+	return elem.Value.(*cachedResponse)
+}
+
+// Store adds a completed response, evicting the least recently used entries
+// to stay within cacheMaxBytes.
+func (rc *ResponseCache) Store(key string, tokens []string, summary *pb.QuerySummary) {
+	entry := &cachedResponse{
+		key:     key,
+		tokens:  tokens,
+		summary: summary,
+		expires: time.Now().Add(cacheTTL),
+		size:    len(key),
+	}
+	for _, token := range tokens {
+		entry.size += len(token)
+	}
+	if entry.size > cacheMaxBytes {
+		return
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if elem, ok := rc.entries[key]; ok {
+		rc.remove(elem)
+	}
+	rc.entries[key] = rc.lru.PushFront(entry)
+	rc.bytes += entry.size
+	for rc.bytes > cacheMaxBytes {
+		rc.remove(rc.lru.Back())
+		rc.evictions++
+	}
+}
+
+// remove must be called with rc.mu held.
+func (rc *ResponseCache) remove(elem *list.Element) {
+	entry := rc.lru.Remove(elem).(*cachedResponse)
+	delete(rc.entries, entry.key)
+	rc.bytes -= entry.size
+}
+
+// replay answers req from the cache, moving it through the same states and
+// events as a generation would, so its consumer cannot tell the difference
+// except for the pace.
+func (cr *cachedResponse) replay(req *Request) {
+	log.Printf("[Cache] Replaying %d cached tokens for query: %s", len(cr.tokens), req.query)
+	req.transition(StateDispatched)
+	for i, token := range cr.tokens {
+		if i == 0 {
+			req.transition(StateStreaming)
+		} else {
+			time.Sleep(cacheReplayDelay)
+		}
+		resp := &pb.QueryResponse{Event: &pb.QueryResponse_Token{Token: &pb.TokenDelta{Text: token}}}
+		if !req.send(resp) {
+			req.transition(StateCancelled)
+			return
+		}
+	}
+	req.send(&pb.QueryResponse{Event: &pb.QueryResponse_Summary{Summary: cr.summary}})
+	req.transition(StateCompleted)
+}
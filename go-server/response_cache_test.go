@@ -0,0 +1,206 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/GeorgeMichailov/personalllmchat/go-server/fakemodel"
+	pb "github.com/GeorgeMichailov/personalllmchat/go-server/model-service"
+	"github.com/GeorgeMichailov/personalllmchat/go-server/wsproto"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// newTestCache returns an empty cache that, unlike createResponseCache, does
+// not publish itself on /debug/vars.
+func newTestCache() *ResponseCache {
+	return &ResponseCache{entries: make(map[string]*list.Element), lru: list.New()}
+}
+
+// enableCache switches the response cache on until the test ends.
+func enableCache(t *testing.T) {
+	prevEnabled, prevNondeterministic := responseCacheEnabled, cacheNondeterministic
+	responseCacheEnabled, cacheNondeterministic = true, false
+	t.Cleanup(func() {
+		responseCacheEnabled, cacheNondeterministic = prevEnabled, prevNondeterministic
+	})
+}
+
+func TestCacheKey(t *testing.T) {
+	enableCache(t)
+	seed := int64(7)
+	greedy := &pb.SamplingParams{Temperature: 0, MaxTokens: 10}
+	sampled := &pb.SamplingParams{Temperature: 0.7, MaxTokens: 10}
+	seeded := &pb.SamplingParams{Temperature: 0.7, MaxTokens: 10, Seed: &seed}
+
+	tests := []struct {
+		name             string
+		query            string
+		params           *pb.SamplingParams
+		nondeterministic bool
+		cached           bool
+	}{
+		{"temperature 0", "hello", greedy, false, true},
+		{"seeded", "hello", seeded, false, true},
+		{"sampled", "hello", sampled, false, false},
+		{"sampled with LLM_CACHE_NONDETERMINISTIC", "hello", sampled, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cacheNondeterministic = tt.nondeterministic
+			defer func() { cacheNondeterministic = false }()
+			if key := cacheKey(tt.query, tt.params); (key != "") != tt.cached {
+				t.Errorf("cacheKey = %q, want cached %v", key, tt.cached)
+			}
+		})
+	}
+
+	// Whitespace does not matter; the query, parameters and model do.
+	key := cacheKey("hello  world", greedy)
+	if got := cacheKey(" hello\nworld ", greedy); got != key {
+		t.Error("queries differing only in whitespace have different keys")
+	}
+	if cacheKey("hello world!", greedy) == key {
+		t.Error("different queries share a key")
+	}
+	if cacheKey("hello world", &pb.SamplingParams{Temperature: 0, MaxTokens: 11}) == key {
+		t.Error("different parameters share a key")
+	}
+	defer func(prev string) { modelName = prev }(modelName)
+	modelName = "other_model"
+	if cacheKey("hello world", greedy) == key {
+		t.Error("different models share a key")
+	}
+
+	responseCacheEnabled = false
+	if key := cacheKey("hello", greedy); key != "" {
+		t.Errorf("cacheKey = %q with the cache off", key)
+	}
+}
+
+func TestResponseCacheStore(t *testing.T) {
+	defer func(prev int) { cacheMaxBytes = prev }(cacheMaxBytes)
+	defer func(prev time.Duration) { cacheTTL = prev }(cacheTTL)
+	cacheTTL = time.Hour
+
+	summary := &pb.QuerySummary{FinishReason: "stop"}
+	tokens := []string{"0123456789"} // entries are 11 bytes with a 1 byte key
+
+	tests := []struct {
+		name     string
+		maxBytes int
+		ttl      time.Duration
+		store    []string // keys, in order
+		lookup   []string // between the stores, before the last one
+		want     map[string]bool
+		evicted  int64
+	}{
+		{"fits", 100, time.Hour, []string{"a", "b", "c"}, nil, map[string]bool{"a": true, "b": true, "c": true}, 0},
+		{"evicts the oldest", 25, time.Hour, []string{"a", "b", "c"}, nil, map[string]bool{"a": false, "b": true, "c": true}, 1},
+		{"evicts the least recently used", 25, time.Hour, []string{"a", "b", "c"}, []string{"a"}, map[string]bool{"a": true, "b": false, "c": true}, 1},
+		{"too large to keep", 5, time.Hour, []string{"a"}, nil, map[string]bool{"a": false}, 0},
+		{"expired", 100, -time.Second, []string{"a"}, nil, map[string]bool{"a": false}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cacheMaxBytes, cacheTTL = tt.maxBytes, tt.ttl
+			rc := newTestCache()
+			for i, key := range tt.store {
+				if i == len(tt.store)-1 {
+					for _, key := range tt.lookup {
+						rc.Lookup(key)
+					}
+				}
+				rc.Store(key, tokens, summary)
+			}
+			rc.hits, rc.misses = 0, 0
+
+			var hits, misses int64
+			for key, want := range tt.want {
+				got := rc.Lookup(key)
+				if (got != nil) != want {
+					t.Errorf("Lookup(%q) = %v, want cached %v", key, got, want)
+				}
+				if got != nil {
+					hits++
+				} else {
+					misses++
+				}
+			}
+			if rc.hits != hits || rc.misses != misses || rc.evictions != tt.evicted {
+				t.Errorf("counted %d hits, %d misses, %d evictions; want %d, %d, %d",
+					rc.hits, rc.misses, rc.evictions, hits, misses, tt.evicted)
+			}
+			if rc.bytes > tt.maxBytes {
+				t.Errorf("holds %d bytes, more than %d", rc.bytes, tt.maxBytes)
+			}
+		})
+	}
+}
+
+// The second identical deterministic query is answered from the cache, unless
+// it asks not to be.
+func TestCachedAnswers(t *testing.T) {
+	enableCache(t)
+	startFakeQueue(t, fakemodel.Config{Script: []string{"same", " again"}})
+	srv := newWSServer(t)
+	query := primitive.NewObjectID().Hex() // not cached by an earlier test
+
+	ask := func(noCache bool) wsproto.Done {
+		t.Helper()
+		conn := dialWS(t, srv, "alice", "", wsproto.Subprotocol)
+		writeFrame(t, conn, wsproto.TypeQuery, primitive.NewObjectID().Hex(), map[string]any{
+			"query": query, "chatid": primitive.NewObjectID().Hex(), "temperature": 0, "no_cache": noCache,
+		})
+		for {
+			frame := readFrame(t, conn, nil)
+			switch frame.Type {
+			case wsproto.TypeStatus, wsproto.TypeToken:
+				continue
+			case wsproto.TypeDone:
+				var done wsproto.Done
+				if err := json.Unmarshal(frame.Payload, &done); err != nil {
+					t.Fatal(err)
+				}
+				return done
+			}
+			t.Fatalf("answer ended with a %s frame %s", frame.Type, frame.Payload)
+		}
+	}
+	if ask(false).Cached {
+		t.Error("the first answer came from the cache")
+	}
+	if !ask(false).Cached {
+		t.Error("the second answer did not come from the cache")
+	}
+	if ask(true).Cached {
+		t.Error("an answer with no_cache came from the cache")
+	}
+}
+
+// Once shutdown has begun a cached answer is not replayed either.
+func TestNoReplayWhileDraining(t *testing.T) {
+	enableCache(t)
+	rqm := startFakeQueue(t, fakemodel.Config{})
+	query := primitive.NewObjectID().Hex()
+	params, err := SamplingParams{Temperature: new(float32)}.Resolve(samplingLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	responseCache.Store(cacheKey(query, params), []string{"cached"}, &pb.QuerySummary{FinishReason: "stop"})
+
+	// A session opened before the drain is still read from.
+	conn := dialWS(t, newWSServer(t), "alice", "?session=1", wsproto.Subprotocol)
+	rqm.Drain(context.Background())
+
+	writeFrame(t, conn, wsproto.TypeQuery, primitive.NewObjectID().Hex(), map[string]any{
+		"query": query, "chatid": primitive.NewObjectID().Hex(), "temperature": 0,
+	})
+	var got wsproto.Error
+	if frame := readFrame(t, conn, &got); frame.Type != wsproto.TypeError || got.Code != wsproto.CodeShuttingDown {
+		t.Errorf("got %s %s, want a shutting_down error", frame.Type, frame.Payload)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+
+	pb "github.com/GeorgeMichailov/personalllmchat/go-server/model-service"
+)
+
+// SamplingParams are the optional generation settings a client may send with a
+// query. Nil fields take the server default.
+type SamplingParams struct {
+	Temperature       *float32 `json:"temperature,omitempty" bson:"temperature,omitempty"`
+	TopP              *float32 `json:"top_p,omitempty" bson:"top_p,omitempty"`
+	TopK              *int32   `json:"top_k,omitempty" bson:"top_k,omitempty"`
+	MaxTokens         *int32   `json:"max_tokens,omitempty" bson:"max_tokens,omitempty"`
+	Stop              []string `json:"stop,omitempty" bson:"stop,omitempty"`
+	Seed              *int64   `json:"seed,omitempty" bson:"seed,omitempty"`
+	RepetitionPenalty *float32 `json:"repetition_penalty,omitempty" bson:"repetition_penalty,omitempty"`
+}
+
+type SamplingLimits struct {
+	DefaultTemperature       float32
+	DefaultTopP              float32
+	DefaultMaxTokens         int32
+	DefaultRepetitionPenalty float32
+
+	MaxTemperature       float32
+	MaxTopK              int32
+	MaxTokens            int32
+	MaxStopSequences     int
+	MaxStopLength        int
+	MaxRepetitionPenalty float32
+}
+
+// Defaults match what vllm_server.py used before parameters were configurable.
+var samplingLimits = loadSamplingLimits()
+
+func loadSamplingLimits() SamplingLimits {
+	return SamplingLimits{
+		DefaultTemperature:       float32(envFloat("LLM_DEFAULT_TEMPERATURE", 0.7)),
+		DefaultTopP:              float32(envFloat("LLM_DEFAULT_TOP_P", 0.95)),
+		DefaultMaxTokens:         int32(envInt("LLM_DEFAULT_MAX_TOKENS", 150)),
+		DefaultRepetitionPenalty: 1.0,
+
+		MaxTemperature:       float32(envFloat("LLM_MAX_TEMPERATURE", 2.0)),
+		MaxTopK:              int32(envInt("LLM_MAX_TOP_K", 200)),
+		MaxTokens:            int32(envInt("LLM_MAX_TOKENS", 512)),
+		MaxStopSequences:     envInt("LLM_MAX_STOP_SEQUENCES", 4),
+		MaxStopLength:        envInt("LLM_MAX_STOP_LENGTH", 32),
+		MaxRepetitionPenalty: float32(envFloat("LLM_MAX_REPETITION_PENALTY", 2.0)),
+	}
+}
+
+// Resolve validates the client's parameters against limits and fills in
+// defaults, producing the message forwarded to the model service.
+func (sp SamplingParams) Resolve(limits SamplingLimits) (*pb.SamplingParams, error) {
+	out := &pb.SamplingParams{
+		Temperature:       limits.DefaultTemperature,
+		TopP:              limits.DefaultTopP,
+		TopK:              -1,
+		MaxTokens:         limits.DefaultMaxTokens,
+		RepetitionPenalty: limits.DefaultRepetitionPenalty,
+	}
+
+	if sp.Temperature != nil {
+		if *sp.Temperature < 0 || *sp.Temperature > limits.MaxTemperature {
+			return nil, fmt.Errorf("temperature must be between 0 and %g", limits.MaxTemperature)
+		}
+		out.Temperature = *sp.Temperature
+	}
+
+	if sp.TopP != nil {
+		if *sp.TopP <= 0 || *sp.TopP > 1 {
+			return nil, fmt.Errorf("top_p must be in (0, 1]")
+		}
+		out.TopP = *sp.TopP
+	}
+
+	if sp.TopK != nil {
+		if *sp.TopK != -1 && (*sp.TopK < 1 || *sp.TopK > limits.MaxTopK) {
+			return nil, fmt.Errorf("top_k must be -1 or between 1 and %d", limits.MaxTopK)
+		}
+		out.TopK = *sp.TopK
+	}
+
+	if sp.MaxTokens != nil {
+		if *sp.MaxTokens < 1 || *sp.MaxTokens > limits.MaxTokens {
+			return nil, fmt.Errorf("max_tokens must be between 1 and %d", limits.MaxTokens)
+		}
+		out.MaxTokens = *sp.MaxTokens
+	}
+
+	if len(sp.Stop) > limits.MaxStopSequences {
+		return nil, fmt.Errorf("at most %d stop sequences are allowed", limits.MaxStopSequences)
+	}
+	for _, stop := range sp.Stop {
+		if len(stop) == 0 || len(stop) > limits.MaxStopLength {
+			return nil, fmt.Errorf("stop sequences must be 1 to %d bytes long", limits.MaxStopLength)
+		}
+	}
+	out.Stop = sp.Stop
+
+	if sp.Seed != nil {
+		seed := *sp.Seed
+		out.Seed = &seed
+	}
+
+	if sp.RepetitionPenalty != nil {
+		if *sp.RepetitionPenalty <= 0 || *sp.RepetitionPenalty > limits.MaxRepetitionPenalty {
+			return nil, fmt.Errorf("repetition_penalty must be in (0, %g]", limits.MaxRepetitionPenalty)
+		}
+		out.RepetitionPenalty = *sp.RepetitionPenalty
+	}
+
+	return out, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	pb "github.com/GeorgeMichailov/personalllmchat/go-server/model-service"
+
+	"google.golang.org/protobuf/proto"
+)
+
+var testLimits = SamplingLimits{
+	DefaultTemperature:       0.7,
+	DefaultTopP:              0.95,
+	DefaultMaxTokens:         150,
+	DefaultRepetitionPenalty: 1.0,
+
+	MaxTemperature:       2.0,
+	MaxTopK:              200,
+	MaxTokens:            512,
+	MaxStopSequences:     2,
+	MaxStopLength:        8,
+	MaxRepetitionPenalty: 2.0,
+}
+
+func TestResolve(t *testing.T) {
+	seed := int64(42)
+	tests := []struct {
+		name   string
+		params string // as a client sends them
+		want   *pb.SamplingParams
+		err    string // part of the error, if any
+	}{
+		{"defaults", `{}`, &pb.SamplingParams{Temperature: 0.7, TopP: 0.95, TopK: -1, MaxTokens: 150, RepetitionPenalty: 1}, ""},
+		{"all set",
+			`{"temperature": 0, "top_p": 0.5, "top_k": 40, "max_tokens": 512, "stop": ["\n", "END"], "seed": 42, "repetition_penalty": 1.2}`,
+			&pb.SamplingParams{Temperature: 0, TopP: 0.5, TopK: 40, MaxTokens: 512, Stop: []string{"\n", "END"}, Seed: &seed, RepetitionPenalty: 1.2}, ""},
+		{"top_k off", `{"top_k": -1}`, &pb.SamplingParams{Temperature: 0.7, TopP: 0.95, TopK: -1, MaxTokens: 150, RepetitionPenalty: 1}, ""},
+
+		{"negative temperature", `{"temperature": -0.1}`, nil, "temperature"},
+		{"temperature above the maximum", `{"temperature": 2.1}`, nil, "temperature"},
+		{"top_p of zero", `{"top_p": 0}`, nil, "top_p"},
+		{"top_p above one", `{"top_p": 1.1}`, nil, "top_p"},
+		{"top_k of zero", `{"top_k": 0}`, nil, "top_k"},
+		{"top_k above the maximum", `{"top_k": 201}`, nil, "top_k"},
+		{"max_tokens of zero", `{"max_tokens": 0}`, nil, "max_tokens"},
+		{"max_tokens above the maximum", `{"max_tokens": 513}`, nil, "max_tokens"},
+		{"too many stop sequences", `{"stop": ["a", "b", "c"]}`, nil, "stop sequences"},
+		{"empty stop sequence", `{"stop": [""]}`, nil, "stop sequences"},
+		{"stop sequence too long", `{"stop": ["123456789"]}`, nil, "stop sequences"},
+		{"repetition_penalty of zero", `{"repetition_penalty": 0}`, nil, "repetition_penalty"},
+		{"repetition_penalty above the maximum", `{"repetition_penalty": 2.5}`, nil, "repetition_penalty"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sp SamplingParams
+			if err := json.Unmarshal([]byte(tt.params), &sp); err != nil {
+				t.Fatal(err)
+			}
+			got, err := sp.Resolve(testLimits)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("Resolve(%s) = %v, %v; want an error about %s", tt.params, got, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Resolve(%s): %v", tt.params, err)
+			}
+			if !proto.Equal(got, tt.want) {
+				t.Errorf("Resolve(%s) = %v, want %v", tt.params, got, tt.want)
+			}
+		})
+	}
+}
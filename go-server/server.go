@@ -2,13 +2,24 @@ package main
 
 import (
 	"context"
+	"errors"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/GeorgeMichailov/personalllmchat/go-server/fakemodel"
 
 	"github.com/labstack/echo/v4"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "batch" {
+		os.Exit(runBatchCommand(os.Args[2:]))
+	}
+
 	// Connect DB
 	connectToMongoDB()
 
@@ -24,28 +35,78 @@ func main() {
 	// Socket + Model Service related
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+
+	startFakeModel(ctx)
 	rqManager.Start(ctx)
+	if jobQueueEnabled {
+		jobQueue = createJobQueue(JobCollection)
+		jobQueue.Start(ctx)
+	}
 	e.GET("/ws", func(c echo.Context) error {
 		wsHandler(c.Response(), c.Request())
 		return nil
 	}, JWTMiddleware)
 
-	/*
-		// Socket + Simulated Model Service
-		e.GET("/ws", func(c echo.Context) error {
-			SimulationWsHandler(c.Response(), c.Request())
-			return nil
-		}, JWTMiddleware)
-	*/
-
 	// Controllers
 	UserRouteController(e)
 	ChatRouteController(e)
+	JobRouteController(e)
+	BatchRouteController(e)
+	MetricsRouteController(e)
+	AdminRouteController(e)
 
 	// Server itself
 	port := "8080"
-	log.Printf("Server running on port %s\n", port)
-	if err := e.Start(":" + port); err != nil {
+	serverErr := make(chan error, 1)
+	go func() {
+		log.Printf("Server running on port %s\n", port)
+		serverErr <- e.Start(":" + port)
+	}()
+
+	stop, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+	select {
+	case err := <-serverErr:
 		log.Fatal("Error starting server:", err)
+	case <-stop.Done():
+	}
+	stopSignals() // a second signal kills the process the usual way
+	shutdown(e, cancel)
+}
+
+// startFakeModel runs a simulated model service (no GPU needed) in-process
+// when FAKE_MODEL is set, see also cmd/fakemodel.
+func startFakeModel(ctx context.Context) {
+	if !envBool("FAKE_MODEL") {
+		return
+	}
+	addr, err := fakemodel.Start(ctx, modelServiceAddr, fakemodel.Config{TokenDelay: 50 * time.Millisecond})
+	if err != nil {
+		log.Fatal("Error starting fake model service:", err)
+	}
+	log.Printf("Using fake model service on %s\n", addr)
+}
+
+// shutdown stops the server in dependency order: no new requests, let active
+// generations finish, save their interactions, then close HTTP, the model
+// service connections and Mongo.
+func shutdown(e *echo.Echo, cancelQueue context.CancelFunc) {
+	log.Printf("[Shutdown] Signal received, draining for up to %v", drainTimeout)
+
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer drainCancel()
+	rqManager.Drain(drainCtx)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := FlushInteractions(ctx); err != nil {
+		log.Printf("[Shutdown] Pending chat writes not flushed: %v", err)
+	}
+	if err := e.Shutdown(ctx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("[Shutdown] Error shutting down HTTP server: %v", err)
 	}
+	cancelQueue()
+	disconnectFromMongoDB(ctx)
+	log.Printf("[Shutdown] Done")
 }
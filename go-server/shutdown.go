@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	pb "github.com/GeorgeMichailov/personalllmchat/go-server/model-service"
+)
+
+// How long active generations may keep running once shutdown has begun.
+var drainTimeout = time.Duration(envInt("LLM_DRAIN_TIMEOUT_S", 30)) * time.Second
+
+// After the drain deadline, how long cancelled requests get to save what they
+// have and tell their clients.
+const drainCancelGrace = 5 * time.Second
+
+var errShuttingDown = errors.New("server is shutting down")
+
+func shuttingDownEvent() *pb.QueryResponse {
+	return &pb.QueryResponse{Event: &pb.QueryResponse_Error{
+		Error: &pb.QueryError{Code: "shutting_down", Message: errShuttingDown.Error()},
+	}}
+}
+
+// Draining reports whether Drain has been called.
+func (rqm *RequestQueueManager) Draining() bool {
+	rqm.mu.Lock()
+	defer rqm.mu.Unlock()
+	return rqm.draining
+}
+
+// Finish tells the queue that the consumer of a request accepted by AddRequest
+// is done with it, including any follow-up such as saving the interaction.
+func (rqm *RequestQueueManager) Finish() {
+	rqm.consumers.Done()
+}
+
+// Drain stops accepting requests, tells every queued client that the server is
+// going away, and waits for active requests and their consumers to finish.
+// Requests still running when ctx is done are cancelled.
+func (rqm *RequestQueueManager) Drain(ctx context.Context) {
+	rqm.mu.Lock()
+	rqm.draining = true
+	var queued []*Request
+	rqm.queue.each(func(req *Request) {
+		queued = append(queued, req)
+	})
+	for _, req := range queued {
+		rqm.queue.remove(req)
+		req.expiry.Stop()
+		req.stopCancel()
+		// Nothing has been written to responseCh yet, so this cannot block.
+		req.send(shuttingDownEvent())
+		req.transition(StateCancelled)
+	}
+	active := len(rqm.active)
+	rqm.mu.Unlock()
+	log.Printf("[Shutdown] Draining: %d queued requests dropped, %d active", len(queued), active)
+
+	done := make(chan struct{})
+	go func() {
+		rqm.consumers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		log.Printf("[Shutdown] All requests finished")
+		return
+	case <-ctx.Done():
+	}
+
+	rqm.mu.Lock()
+	log.Printf("[Shutdown] Drain deadline reached, cancelling %d active requests", len(rqm.active))
+	for req := range rqm.active {
+		req.cancel(errShuttingDown)
+	}
+	rqm.mu.Unlock()
+
+	select {
+	case <-done:
+	case <-time.After(drainCancelGrace):
+		log.Printf("[Shutdown] Gave up waiting for cancelled requests")
+	}
+}
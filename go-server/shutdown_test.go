@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GeorgeMichailov/personalllmchat/go-server/fakemodel"
+	"github.com/GeorgeMichailov/personalllmchat/go-server/wsproto"
+
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Drain lets the answer being generated finish, tells the queued client the
+// server is going away and turns new connections away.
+func TestDrain(t *testing.T) {
+	withLimits(t, 1, 1, 1)
+	script := slices.Repeat([]string{"tok "}, 20)
+	rqm := startFakeQueue(t, fakemodel.Config{Script: script, TokenDelay: 10 * time.Millisecond})
+	srv := newWSServer(t)
+
+	ask := func(query string) *websocket.Conn {
+		conn := dialWS(t, srv, "alice", "", wsproto.Subprotocol)
+		writeFrame(t, conn, wsproto.TypeQuery, primitive.NewObjectID().Hex(), map[string]any{
+			"query": query, "chatid": primitive.NewObjectID().Hex(),
+		})
+		return conn
+	}
+	active := ask("answered")
+	if frame := readFrame(t, active, nil); frame.Type != wsproto.TypeStatus {
+		t.Fatalf("got %s %s, want the accepted status", frame.Type, frame.Payload)
+	}
+	if frame := readFrame(t, active, nil); frame.Type != wsproto.TypeToken {
+		t.Fatalf("got %s %s, want the first token", frame.Type, frame.Payload)
+	}
+	queued := ask("dropped")
+	waitFor(t, time.Second, "the second query to be queued", func() bool {
+		rqm.mu.Lock()
+		defer rqm.mu.Unlock()
+		return rqm.queue.Len() == 1
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	drained := make(chan struct{})
+	go func() {
+		rqm.Drain(ctx)
+		close(drained)
+	}()
+
+	for {
+		var got wsproto.Error
+		frame := readFrame(t, queued, nil)
+		if frame.Type == wsproto.TypeStatus {
+			continue
+		}
+		if err := json.Unmarshal(frame.Payload, &got); err != nil || frame.Type != wsproto.TypeError || got.Code != wsproto.CodeShuttingDown {
+			t.Errorf("queued client got %s %s, want a shutting_down error", frame.Type, frame.Payload)
+		}
+		break
+	}
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+	token, err := GenerateJWT("alice", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Authorization": {"Bearer " + token}})
+	if err == nil {
+		conn.Close()
+		t.Error("a new connection was accepted while draining")
+	} else if resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("dialing while draining: %v, want status 503", err)
+	}
+
+	tokens := 1
+	for {
+		frame := readFrame(t, active, nil)
+		if frame.Type == wsproto.TypeToken {
+			tokens++
+			continue
+		}
+		var done wsproto.Done
+		if err := json.Unmarshal(frame.Payload, &done); err != nil || frame.Type != wsproto.TypeDone || done.FinishReason != "stop" {
+			t.Fatalf("answer ended with %s %s, want it to finish", frame.Type, frame.Payload)
+		}
+		break
+	}
+	if tokens != len(script) {
+		t.Errorf("got %d tokens, want all %d", tokens, len(script))
+	}
+
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Drain did not return after the answer finished")
+	}
+	if ctx.Err() != nil {
+		t.Error("Drain waited for its deadline")
+	}
+}
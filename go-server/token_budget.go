@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+
+	pb "github.com/GeorgeMichailov/personalllmchat/go-server/model-service"
+)
+
+// Total prompt plus completion tokens that may be in flight on the backend at
+// once. vLLM's KV cache is sized in tokens, so this bounds memory use in a way
+// a request count cannot: many short chats fit where a few long ones would not.
+var inflightTokenBudget = envInt("LLM_INFLIGHT_TOKEN_BUDGET", 8192)
+
+// Rough bytes-per-token ratio for English text with common BPE vocabularies.
+// The estimate only has to be good enough to pack the backend, not exact.
+const bytesPerToken = 4
+
+// estimateTokens guesses how many tokens query and its completion will occupy
+// on the backend: the prompt plus everything max_tokens allows it to generate.
+func estimateTokens(query string, params *pb.SamplingParams) int {
+	prompt := (len(query) + bytesPerToken - 1) / bytesPerToken
+	return prompt + int(params.GetMaxTokens())
+}
+
+// checkTokenBudget refuses a request needing this many tokens if it could
+// never be dispatched because it alone exceeds the in-flight budget.
+func checkTokenBudget(tokens int) error {
+	if tokens > inflightTokenBudget {
+		return fmt.Errorf("request needs about %d tokens, more than the %d the server allows in flight", tokens, inflightTokenBudget)
+	}
+	return nil
+}
+
+// fitsTokenBudget reports whether req can start without pushing the tokens in
+// flight over budget. Must be called with rqm.mu held.
+func (rqm *RequestQueueManager) fitsTokenBudget(req *Request) bool {
+	return rqm.activeTokens+req.tokens <= inflightTokenBudget
+}
@@ -19,6 +19,7 @@ type User struct {
 	ID       primitive.ObjectID            `json:"id,omitempty" bson:"_id,omitempty"`
 	Username string                        `json:"username" bson:"username"`
 	Password string                        `json:"password" bson:"password"`
+	Role     string                        `json:"role,omitempty" bson:"role,omitempty"`   // "admin" or empty, only set directly in the database
 	Chats    map[primitive.ObjectID]string `json:"chats,omitempty" bson:"chats,omitempty"` // Id : title for now where title will simply be the chat id as a string for now
 }
 
@@ -127,7 +128,7 @@ func Login(c echo.Context) error {
 		return c.JSON(http.StatusUnauthorized, echo.Map{"error": "Invalid username or password"})
 	}
 
-	token, err := GenerateJWT(user.Username)
+	token, err := GenerateJWT(user.Username, user.Role)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to generate token"})
 	}
@@ -248,3 +249,30 @@ func CreateNewUserChat(username string) (bool, primitive.ObjectID) {
 
 	return true, newChat.ID
 }
+
+// DeleteUserChat undoes CreateNewUserChat for a chat that was never used.
+func DeleteUserChat(username string, chatID string) {
+	id, err := primitive.ObjectIDFromHex(chatID)
+	if err != nil {
+		log.Printf("[Error] Invalid chat ID %v: %v", chatID, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := ChatCollection.DeleteOne(ctx, bson.M{"_id": id, "ownerid": username}); err != nil {
+		log.Printf("Failed to delete unused chat %s of %s: %v", chatID, username, err)
+		return
+	}
+	update := bson.M{
+		"$unset": bson.M{
+			"chats." + chatID: "",
+		},
+	}
+	if _, err := UserCollection.UpdateOne(ctx, bson.M{"username": username}, update); err != nil {
+		log.Printf("Failed to update user's chats for %s: %v", username, err)
+		return
+	}
+	log.Printf("Deleted unused chat %s of %s", chatID, username)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/GeorgeMichailov/personalllmchat/go-server/wsproto"
+
+	"github.com/gorilla/websocket"
+)
+
+// Typed answers survive a dropped connection. Every frame of an answer is kept
+// in its wsStream; when the client goes away the generation goes on for
+// wsResumeWindow, and a client that reconnects in time sends a resume frame
+// with the last seq it saw to be sent the rest, then the answer live. Streams
+// are forgotten wsResumeWindow after their answer ended.
+
+var wsResumeWindow = time.Duration(envInt("LLM_WS_RESUME_WINDOW_S", 120)) * time.Second
+
+var (
+	errNotResumable = errors.New("no answer to resume with that request_id")
+	errStreamInUse  = errors.New("request_id is already in use by an answer that can be resumed")
+)
+
+type streamKey struct {
+	owner     string
+	requestID string
+}
+
+// wsStream is the record of one typed answer and the connection it is
+// currently sent to.
+type wsStream struct {
+	key    streamKey
+	cancel context.CancelCauseFunc // cancels the query
+	done   chan struct{}           // closed once the answer has ended
+
+	mu      sync.Mutex
+	conn    *wsConn // nil while no client is attached
+	frames  [][]byte
+	sent    int  // frames conn has been sent
+	sending bool // a goroutine is in flush
+	ended   bool
+	abandon *time.Timer // cancels the query if nobody resumes it in time
+}
+
+var streams = struct {
+	mu   sync.Mutex
+	byID map[streamKey]*wsStream
+}{byID: make(map[streamKey]*wsStream)}
+
+// retainStream starts the record of owner's answer to requestID, sent to
+// conn. It fails with errStreamInUse while owner still has an answer under
+// requestID, which a resume would otherwise not find.
+func retainStream(conn *wsConn, owner, requestID string, cancel context.CancelCauseFunc) (*wsStream, error) {
+	st := &wsStream{
+		key:    streamKey{owner, requestID},
+		cancel: cancel,
+		done:   make(chan struct{}),
+		conn:   conn,
+	}
+	streams.mu.Lock()
+	defer streams.mu.Unlock()
+	if _, ok := streams.byID[st.key]; ok {
+		return nil, errStreamInUse
+	}
+	streams.byID[st.key] = st
+	return st, nil
+}
+
+func lookupStream(owner, requestID string) *wsStream {
+	streams.mu.Lock()
+	defer streams.mu.Unlock()
+	return streams.byID[streamKey{owner, requestID}]
+}
+
+// write numbers and records frame, and sends it if a client is attached. A
+// failed send detaches the client rather than failing the answer.
+func (st *wsStream) write(frame wsproto.Frame) error {
+	st.mu.Lock()
+	frame.Seq = int64(len(st.frames) + 1)
+	msg, err := json.Marshal(frame)
+	if err != nil {
+		st.mu.Unlock()
+		return err
+	}
+	st.frames = append(st.frames, msg)
+	st.mu.Unlock()
+
+	st.flush()
+	return nil
+}
+
+// attach sends conn the frames after lastSeq and then the rest of the answer
+// live, taking the stream over from any connection it was sent to before.
+func (st *wsStream) attach(conn *wsConn, lastSeq int64) {
+	st.mu.Lock()
+	if st.abandon != nil {
+		st.abandon.Stop()
+		st.abandon = nil
+	}
+	from := min(max(lastSeq, 0), int64(len(st.frames)))
+	log.Printf("[WebSocket] Resuming request %s of %s after frame %d of %d", st.key.requestID, st.key.owner, from, len(st.frames))
+	st.conn, st.sent = conn, int(from)
+	st.mu.Unlock()
+
+	st.flush()
+}
+
+// flush sends the attached client the frames it has not been sent yet. The
+// sends happen without st.mu held, so a slow client holds up neither the
+// answer nor a resume on another connection. Only one goroutine sends at a
+// time, which keeps the frames in order; the others leave their frames to it.
+func (st *wsStream) flush() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.sending {
+		return
+	}
+	st.sending = true
+	for st.conn != nil && st.sent < len(st.frames) {
+		conn, from, pending := st.conn, st.sent, st.frames[st.sent:]
+		st.mu.Unlock()
+		n, err := sendFrames(conn, pending)
+		st.mu.Lock()
+
+		if st.conn == conn { // not taken over while sending
+			st.sent = from + n
+			if err != nil {
+				st.conn = nil
+			}
+		}
+	}
+	st.sending = false
+}
+
+// sendFrames sends msgs to conn, returning how many were sent.
+func sendFrames(conn *wsConn, msgs [][]byte) (int, error) {
+	for i, msg := range msgs {
+		if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+			return i, err
+		}
+	}
+	return len(msgs), nil
+}
+
+// detach stops sending to conn, which has gone away, and gives a client until
+// wsResumeWindow to resume an answer still being generated.
+func (st *wsStream) detach(conn *wsConn) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.conn != nil && st.conn != conn {
+		return // already taken over by a newer connection
+	}
+	st.conn = nil
+	if !st.ended && st.abandon == nil {
+		st.abandon = time.AfterFunc(wsResumeWindow, func() {
+			st.forget() // what is left of it would never be complete
+			st.cancel(errClientGone)
+		})
+	}
+}
+
+// end marks the answer complete; it can still be resumed for wsResumeWindow.
+func (st *wsStream) end() {
+	st.mu.Lock()
+	st.ended = true
+	if st.abandon != nil {
+		st.abandon.Stop()
+		st.abandon = nil
+	}
+	st.mu.Unlock()
+	close(st.done)
+
+	time.AfterFunc(wsResumeWindow, st.forget)
+}
+
+func (st *wsStream) forget() {
+	streams.mu.Lock()
+	defer streams.mu.Unlock()
+	if streams.byID[st.key] == st {
+		delete(streams.byID, st.key)
+	}
+}
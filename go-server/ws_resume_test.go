@@ -0,0 +1,100 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/GeorgeMichailov/personalllmchat/go-server/fakemodel"
+	"github.com/GeorgeMichailov/personalllmchat/go-server/wsproto"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// A client that loses its connection mid-answer resumes it on a new one and
+// is sent every frame after the last it saw, in order, up to the done frame.
+func TestResume(t *testing.T) {
+	script := slices.Repeat([]string{"tok "}, 20)
+	startFakeQueue(t, fakemodel.Config{Script: script, TokenDelay: 10 * time.Millisecond})
+	srv := newWSServer(t)
+
+	requestID := primitive.NewObjectID().Hex()
+	conn := dialWS(t, srv, "alice", "", wsproto.Subprotocol)
+	writeFrame(t, conn, wsproto.TypeQuery, requestID, map[string]any{"query": "keep going", "chatid": primitive.NewObjectID().Hex()})
+
+	var lastSeq int64
+	for lastSeq < 4 { // the accepted status and three tokens
+		lastSeq = readFrame(t, conn, nil).Seq
+	}
+	conn.UnderlyingConn().Close()
+
+	conn = dialWS(t, srv, "alice", "", wsproto.Subprotocol)
+	frame, err := wsproto.NewFrame(wsproto.TypeResume, requestID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame.Seq = lastSeq
+	if err := conn.WriteJSON(frame); err != nil {
+		t.Fatal(err)
+	}
+
+	tokens := 3
+	for {
+		frame := readFrame(t, conn, nil)
+		if frame.Seq != lastSeq+1 {
+			t.Fatalf("got %s frame %d after %d", frame.Type, frame.Seq, lastSeq)
+		}
+		lastSeq = frame.Seq
+		if frame.Type == wsproto.TypeToken {
+			tokens++
+			continue
+		}
+		if frame.Type != wsproto.TypeDone {
+			t.Fatalf("answer ended with a %s frame %s", frame.Type, frame.Payload)
+		}
+		break
+	}
+	if tokens != len(script) {
+		t.Errorf("got %d tokens across both connections, want %d", tokens, len(script))
+	}
+	<-lookupStream("alice", requestID).done
+}
+
+// A query may not take the request_id of an answer that can still be resumed:
+// the answer would be lost to a client resuming it.
+func TestResumableRequestIDInUse(t *testing.T) {
+	startFakeQueue(t, fakemodel.Config{Script: []string{"first"}})
+	srv := newWSServer(t)
+	requestID := primitive.NewObjectID().Hex()
+	query := map[string]any{"query": "same id", "chatid": primitive.NewObjectID().Hex()}
+
+	conn := dialWS(t, srv, "alice", "", wsproto.Subprotocol)
+	writeFrame(t, conn, wsproto.TypeQuery, requestID, query)
+	for readFrame(t, conn, nil).Type != wsproto.TypeDone {
+	}
+	<-lookupStream("alice", requestID).done
+
+	for _, session := range []string{"", "?session=1"} {
+		conn := dialWS(t, srv, "alice", session, wsproto.Subprotocol)
+		writeFrame(t, conn, wsproto.TypeQuery, requestID, query)
+		var got wsproto.Error
+		if frame := readFrame(t, conn, &got); got.Code != wsproto.CodeInvalidRequest {
+			t.Errorf("reusing the request_id%s got %s %s, want an invalid_request error", session, frame.Type, frame.Payload)
+		}
+	}
+
+	// The first answer is still there to be resumed.
+	conn = dialWS(t, srv, "alice", "", wsproto.Subprotocol)
+	frame, err := wsproto.NewFrame(wsproto.TypeResume, requestID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame.Seq = 1
+	if err := conn.WriteJSON(frame); err != nil {
+		t.Fatal(err)
+	}
+	var token wsproto.Token
+	if frame := readFrame(t, conn, &token); frame.Type != wsproto.TypeToken || token.Text != "first" {
+		t.Errorf("resumed with %s %s, want the first answer's token", frame.Type, frame.Payload)
+	}
+}
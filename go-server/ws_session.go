@@ -0,0 +1,523 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	pb "github.com/GeorgeMichailov/personalllmchat/go-server/model-service"
+	"github.com/GeorgeMichailov/personalllmchat/go-server/wsproto"
+
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// A session is a WebSocket that stays open for many queries, opened with
+// /ws?session=1. Each query is tagged with a request_id that every JSON frame
+// of its answer repeats. Typed sessions answer up to wsMaxConcurrent queries
+// at once, interleaving their frames; untyped ones, whose tokens carry no id,
+// answer them in the order they arrive. The server pings the client to notice
+// dead connections and closes sessions that have been idle for wsIdleTimeout.
+
+var (
+	wsPingInterval  = time.Duration(envInt("LLM_WS_PING_INTERVAL_S", 30)) * time.Second
+	wsIdleTimeout   = time.Duration(envInt("LLM_WS_IDLE_TIMEOUT_S", 300)) * time.Second
+	wsMaxConcurrent = envInt("LLM_WS_MAX_CONCURRENT", 4)
+)
+
+const (
+	wsWriteWait = 10 * time.Second
+
+	// Queries a session holds while answering another; more are refused.
+	sessionBacklog = 4
+)
+
+// wsConn is a WebSocket connection that several goroutines may write to.
+type wsConn struct {
+	*websocket.Conn
+	typed bool // the client negotiated wsproto.Subprotocol
+	mu    sync.Mutex
+}
+
+func (c *wsConn) WriteMessage(messageType int, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.write(messageType, data)
+}
+
+// write sends a message, giving up on a client that has not taken it within
+// wsWriteWait. Must be called with c.mu held.
+func (c *wsConn) write(messageType int, data []byte) error {
+	c.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return c.Conn.WriteMessage(messageType, data)
+}
+
+// keepAlive pings the client until ctx is done. The pongs extend the read
+// deadline set by serveSession.
+func (c *wsConn) keepAlive(ctx context.Context) {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// closeWith ends the connection with a close frame telling the client why.
+func (c *wsConn) closeWith(code int, reason string) {
+	c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(wsWriteWait))
+}
+
+// decodeMessage reads a client message in the connection's protocol. An
+// untyped message is a query or a stop message, which is returned as a frame
+// of that type. The query is only set for query frames. The frame is returned even if it is
+// invalid, so the error can be sent with its request id.
+func (c *wsConn) decodeMessage(message []byte) (wsproto.Frame, IncomingWSMessage, error) {
+	var frame wsproto.Frame
+	var incoming IncomingWSMessage
+	if !c.typed {
+		if err := json.Unmarshal(message, &incoming); err != nil {
+			return frame, incoming, errInvalidJSON
+		}
+		frame = wsproto.Frame{Type: wsproto.TypeQuery, RequestID: incoming.RequestID}
+		if incoming.StopGenerating {
+			frame.Type = wsproto.TypeStop
+		}
+		return frame, incoming, nil
+	}
+
+	if err := json.Unmarshal(message, &frame); err != nil {
+		return frame, incoming, errInvalidJSON
+	}
+	switch frame.Type {
+	case wsproto.TypeQuery:
+		if err := json.Unmarshal(frame.Payload, &incoming); err != nil {
+			return frame, incoming, errInvalidJSON
+		}
+		incoming.RequestID = frame.RequestID
+	case wsproto.TypeCancel, wsproto.TypeResume:
+		if frame.RequestID == "" {
+			return frame, incoming, fmt.Errorf("%s needs a request_id", frame.Type)
+		}
+	case wsproto.TypeStop:
+	default:
+		return frame, incoming, fmt.Errorf("unexpected %q frame", frame.Type)
+	}
+	return frame, incoming, nil
+}
+
+var errInvalidJSON = errors.New("Invalid JSON format")
+
+// wsReply writes the frames answering one query in the connection's
+// protocol. Untyped frames outside a session, where requestID is empty, are
+// the ones single-query clients have always had.
+type wsReply struct {
+	conn      *wsConn
+	requestID string
+	seq       int64     // of the last typed frame, guarded by conn.mu
+	stream    *wsStream // if set, typed frames go through it, see ws_resume.go
+}
+
+func newReply(conn *wsConn, requestID string) *wsReply {
+	return &wsReply{conn: conn, requestID: requestID}
+}
+
+// frame writes a typed frame.
+func (r *wsReply) frame(t wsproto.Type, payload any) error {
+	frame, err := wsproto.NewFrame(t, r.requestID, payload)
+	if err != nil {
+		log.Printf("[WebSocket] Failed to encode %s frame: %v", t, err)
+		return err
+	}
+	if r.stream != nil {
+		return r.stream.write(frame)
+	}
+
+	r.conn.mu.Lock()
+	defer r.conn.mu.Unlock()
+	r.seq++
+	frame.Seq = r.seq
+	msg, err := json.Marshal(frame)
+	if err != nil {
+		return err
+	}
+	return r.conn.write(websocket.TextMessage, msg)
+}
+
+// json writes an untyped JSON frame.
+func (r *wsReply) json(frame map[string]any) error {
+	if r.requestID != "" {
+		frame["request_id"] = r.requestID
+	}
+	data, _ := json.Marshal(frame)
+	return r.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+func (r *wsReply) token(text string) error {
+	if r.conn.typed {
+		return r.frame(wsproto.TypeToken, wsproto.Token{Text: text})
+	}
+	return r.conn.WriteMessage(websocket.TextMessage, []byte(text))
+}
+
+func (r *wsReply) status(st QueueStatus) error {
+	if r.conn.typed {
+		// The done or error frame tells how the request ended.
+		if st.Status == "completed" || st.Status == "expired" {
+			return nil
+		}
+		return r.frame(wsproto.TypeStatus, wsproto.Status{Status: st.Status, Position: st.Position, EtaMs: st.EtaMs})
+	}
+	st.RequestID = r.requestID
+	data, _ := json.Marshal(st)
+	return r.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// accepted tells the client which chat the query is added to. Untyped
+// single-query clients are not told.
+func (r *wsReply) accepted(chatID string) error {
+	if r.conn.typed {
+		return r.frame(wsproto.TypeStatus, wsproto.Status{Status: "accepted", ChatID: chatID})
+	}
+	if r.requestID == "" {
+		return nil
+	}
+	return r.json(map[string]any{"status": "accepted", "chatid": chatID})
+}
+
+func (r *wsReply) jobQueued(job *Job) error {
+	if r.conn.typed {
+		return r.frame(wsproto.TypeStatus, wsproto.Status{Status: "job_queued", JobID: job.ID.Hex()})
+	}
+	return r.json(map[string]any{"job_id": job.ID.Hex(), "status": job.Status})
+}
+
+func (r *wsReply) error(code, msg string) error {
+	if r.conn.typed {
+		return r.frame(wsproto.TypeError, wsproto.Error{Code: code, Message: msg})
+	}
+	return r.json(map[string]any{"error": msg, "code": code})
+}
+
+func (r *wsReply) overloaded(err *OverloadedError) error {
+	if r.conn.typed {
+		return r.frame(wsproto.TypeError, wsproto.Error{
+			Code:       wsproto.CodeOverloaded,
+			Message:    err.Error(),
+			RetryAfter: err.RetryAfterSeconds(),
+		})
+	}
+	return r.json(overloadedFrame(err))
+}
+
+// refused reports why AddRequest refused a request.
+func (r *wsReply) refused(err error) error {
+	var overloaded *OverloadedError
+	if errors.As(err, &overloaded) {
+		return r.overloaded(overloaded)
+	}
+	code := wsproto.CodeInvalidRequest
+	if errors.Is(err, errShuttingDown) {
+		code = wsproto.CodeShuttingDown
+	}
+	return r.error(code, err.Error())
+}
+
+// expired reports a request that never left the queue. Untyped clients only
+// learn of it from the "expired" status.
+func (r *wsReply) expired() error {
+	if r.conn.typed {
+		return r.error(wsproto.CodeExpired, "request expired in the queue")
+	}
+	return nil
+}
+
+func (r *wsReply) timeout() error {
+	if r.conn.typed {
+		return r.error(wsproto.CodeTimeout, "no response received")
+	}
+	return r.conn.WriteMessage(websocket.TextMessage, []byte("Timeout: no response received."))
+}
+
+func (r *wsReply) done(summary *pb.QuerySummary, cached bool) error {
+	if r.conn.typed {
+		return r.frame(wsproto.TypeDone, wsproto.Done{
+			FinishReason: summary.FinishReason,
+			Usage: wsproto.Usage{
+				PromptTokens:     int(summary.PromptTokens),
+				CompletionTokens: int(summary.CompletionTokens),
+			},
+			LatencyMs: summary.LatencyMs,
+			Cached:    cached,
+		})
+	}
+	// Clients still expect the "[END]" frame to mark the end of a reply.
+	return r.conn.WriteMessage(websocket.TextMessage, []byte("[END]"))
+}
+
+var errCancelledByClient = errors.New("cancelled by client")
+
+// wsSession is the state of one session connection.
+type wsSession struct {
+	conn   *wsConn
+	claims *Claims
+	ctx    context.Context // cancelled when the session ends
+	cancel context.CancelCauseFunc
+
+	queue chan *sessionQuery // untyped queries, answered in order by answerInOrder
+	wg    sync.WaitGroup
+
+	mu         sync.Mutex
+	inflight   map[string]*sessionQuery // accepted or resumed queries that have not ended
+	lastActive time.Time                // when the last query ended
+	closed     bool                     // no more queries are accepted
+}
+
+type sessionQuery struct {
+	ctx      context.Context
+	cancel   context.CancelCauseFunc
+	reply    *wsReply
+	incoming *IncomingWSMessage
+}
+
+// serveSession answers queries on conn until the client leaves, stops
+// answering pings, or sends nothing for wsIdleTimeout.
+func serveSession(conn *wsConn, claims *Claims) {
+	log.Printf("[WebSocket] Session opened for %s", claims.Username)
+	defer log.Printf("[WebSocket] Session closed for %s", claims.Username)
+
+	s := &wsSession{
+		conn:       conn,
+		claims:     claims,
+		queue:      make(chan *sessionQuery, sessionBacklog+1),
+		inflight:   make(map[string]*sessionQuery),
+		lastActive: time.Now(),
+	}
+	s.ctx, s.cancel = context.WithCancelCause(context.Background())
+	// Untyped queries still running are cancelled and waited for, so they
+	// are done with the connection before it is closed. Typed ones go on
+	// without it until they end or are abandoned.
+	defer func() {
+		s.cancel(nil)
+		s.mu.Lock()
+		s.closed = true
+		for _, q := range s.inflight {
+			if q.reply.stream != nil {
+				q.reply.stream.detach(conn)
+			}
+		}
+		s.mu.Unlock()
+		s.wg.Wait()
+	}()
+
+	pongWait := 2 * wsPingInterval
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	go conn.keepAlive(s.ctx)
+
+	if !conn.typed {
+		s.wg.Add(1)
+		go s.answerInOrder()
+	}
+	// Reading goes on while queries are answered, so a client that leaves
+	// is noticed right away.
+	go s.read()
+
+	idle := time.NewTimer(wsIdleTimeout)
+	defer idle.Stop()
+	for {
+		select {
+		case <-idle.C:
+			if wait := s.untilIdle(); wait > 0 {
+				idle.Reset(wait)
+				continue
+			}
+			log.Printf("[WebSocket] Closing idle session for %s", claims.Username)
+			conn.closeWith(websocket.CloseNormalClosure, "idle timeout")
+			return
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *wsSession) read() {
+	for {
+		_, message, err := s.conn.ReadMessage()
+		if err != nil {
+			s.cancel(errClientGone)
+			return
+		}
+		frame, incoming, err := s.conn.decodeMessage(message)
+		if err != nil {
+			newReply(s.conn, frame.RequestID).error(wsproto.CodeInvalidRequest, err.Error())
+			continue
+		}
+		switch frame.Type {
+		case wsproto.TypeQuery:
+			s.accept(&incoming)
+		case wsproto.TypeCancel:
+			s.cancelQuery(frame.RequestID, errCancelledByClient)
+		case wsproto.TypeStop:
+			s.cancelQuery(frame.RequestID, errStoppedByUser)
+		case wsproto.TypeResume:
+			s.resume(frame.RequestID, frame.Seq)
+		}
+	}
+}
+
+// admit registers q unless the session is closed or already has as many
+// queries as it may, which the client is told.
+func (s *wsSession) admit(q *sessionQuery) bool {
+	limit := wsMaxConcurrent
+	if !s.conn.typed {
+		limit = sessionBacklog + 1
+	}
+
+	// The refusal is sent after unlocking, so a slow client does not hold up
+	// the queries that are ending.
+	var code, msg string
+	s.mu.Lock()
+	switch _, inUse := s.inflight[q.reply.requestID]; {
+	case s.closed:
+		s.mu.Unlock()
+		return false
+	case inUse:
+		code, msg = wsproto.CodeInvalidRequest, "request_id is already in use on this session"
+	case len(s.inflight) >= limit:
+		code, msg = wsproto.CodeBusy, fmt.Sprintf("At most %d queries may be outstanding on this session", limit)
+	default:
+		s.inflight[q.reply.requestID] = q
+	}
+	s.mu.Unlock()
+
+	if code != "" {
+		q.reply.error(code, msg)
+		return false
+	}
+	return true
+}
+
+// accept starts answering a query, or queues it on an untyped session.
+func (s *wsSession) accept(incoming *IncomingWSMessage) {
+	if incoming.RequestID == "" {
+		incoming.RequestID = primitive.NewObjectID().Hex()
+	}
+	q := &sessionQuery{reply: newReply(s.conn, incoming.RequestID), incoming: incoming}
+	if !s.conn.typed {
+		q.ctx, q.cancel = context.WithCancelCause(s.ctx)
+		if s.admit(q) {
+			s.queue <- q // never blocks, the queue has room for the limit
+		}
+		return
+	}
+
+	// A typed answer does not depend on the connection, see ws_resume.go.
+	q.ctx, q.cancel = context.WithCancelCause(context.Background())
+	if !s.admit(q) {
+		q.cancel(nil)
+		return
+	}
+	st, err := retainStream(s.conn, s.claims.Username, incoming.RequestID, q.cancel)
+	if err != nil {
+		s.finished(q)
+		q.reply.error(wsproto.CodeInvalidRequest, err.Error())
+		return
+	}
+	q.reply.stream = st
+	go func() {
+		serveQuery(q.ctx, q.reply, s.claims, q.incoming)
+		s.finished(q)
+		q.reply.stream.end()
+	}()
+}
+
+// resume attaches an answer begun on an earlier connection to this session.
+func (s *wsSession) resume(requestID string, lastSeq int64) {
+	reply := newReply(s.conn, requestID)
+	st := lookupStream(s.claims.Username, requestID)
+	if st == nil {
+		reply.error(wsproto.CodeNotResumable, errNotResumable.Error())
+		return
+	}
+	q := &sessionQuery{cancel: st.cancel, reply: reply}
+	if !s.admit(q) {
+		return
+	}
+	reply.stream = st
+
+	st.attach(s.conn, lastSeq)
+	go func() {
+		select {
+		case <-st.done:
+			s.finished(q)
+		case <-s.ctx.Done():
+		}
+	}()
+}
+
+// cancelQuery cancels an outstanding query for cause, errCancelledByClient
+// or errStoppedByUser. A query that has already ended is left alone, since the
+// client may not have seen its end yet.
+func (s *wsSession) cancelQuery(requestID string, cause error) {
+	s.mu.Lock()
+	q, ok := s.inflight[requestID]
+	s.mu.Unlock()
+	if ok {
+		log.Printf("[WebSocket] Request %s of %s %v", requestID, s.claims.Username, cause)
+		q.cancel(cause)
+	}
+}
+
+func (s *wsSession) answerInOrder() {
+	defer s.wg.Done()
+	for {
+		select {
+		case q := <-s.queue:
+			serveQuery(q.ctx, q.reply, s.claims, q.incoming)
+			s.finished(q)
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *wsSession) finished(q *sessionQuery) {
+	q.cancel(nil)
+
+	s.mu.Lock()
+	if s.inflight[q.reply.requestID] == q {
+		delete(s.inflight, q.reply.requestID)
+	}
+	s.lastActive = time.Now()
+	outstanding := len(s.inflight)
+	s.mu.Unlock()
+
+	if outstanding == 0 && rqManager.Draining() {
+		s.conn.closeWith(websocket.CloseGoingAway, errShuttingDown.Error())
+		s.cancel(errShuttingDown)
+	}
+}
+
+// untilIdle returns how long until the session has been idle for
+// wsIdleTimeout, or 0 if it has been.
+func (s *wsSession) untilIdle() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.inflight) > 0 {
+		return wsIdleTimeout
+	}
+	return max(wsIdleTimeout-time.Since(s.lastActive), 0)
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/GeorgeMichailov/personalllmchat/go-server/fakemodel"
+	"github.com/GeorgeMichailov/personalllmchat/go-server/wsproto"
+
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// readFrame reads the next typed frame and decodes its payload into payload.
+func readFrame(t *testing.T, conn *websocket.Conn, payload any) wsproto.Frame {
+	t.Helper()
+	var frame wsproto.Frame
+	if err := conn.ReadJSON(&frame); err != nil {
+		t.Fatalf("reading frame: %v", err)
+	}
+	if payload != nil {
+		if err := json.Unmarshal(frame.Payload, payload); err != nil {
+			t.Fatalf("decoding %s payload %s: %v", frame.Type, frame.Payload, err)
+		}
+	}
+	return frame
+}
+
+func writeFrame(t *testing.T, conn *websocket.Conn, typ wsproto.Type, requestID string, payload any) {
+	t.Helper()
+	frame, err := wsproto.NewFrame(typ, requestID, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteJSON(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Clients that do not offer the subprotocol keep the untyped protocol.
+func TestSubprotocolNegotiation(t *testing.T) {
+	startFakeQueue(t, fakemodel.Config{Script: []string{"hi", " there"}})
+	srv := newWSServer(t)
+	chatID := primitive.NewObjectID().Hex()
+
+	t.Run("untyped", func(t *testing.T) {
+		conn := dialWS(t, srv, "alice", "")
+		if p := conn.Subprotocol(); p != "" {
+			t.Fatalf("negotiated %q without offering it", p)
+		}
+		if err := conn.WriteJSON(map[string]any{"query": "untyped hello", "chatid": chatID}); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatalf("reading after %q: %v", got, err)
+			}
+			if string(msg) == "[END]" {
+				break
+			}
+			got = append(got, string(msg))
+		}
+		if text := strings.Join(got, ""); text != "hi there" {
+			t.Errorf("got %q, want the bare tokens of %q", got, "hi there")
+		}
+	})
+
+	t.Run("typed", func(t *testing.T) {
+		conn := dialWS(t, srv, "alice", "", "other.v9", wsproto.Subprotocol)
+		if p := conn.Subprotocol(); p != wsproto.Subprotocol {
+			t.Fatalf("negotiated %q, want %q", p, wsproto.Subprotocol)
+		}
+		writeFrame(t, conn, wsproto.TypeQuery, primitive.NewObjectID().Hex(), map[string]any{"query": "typed hello", "chatid": chatID})
+		var status wsproto.Status
+		if frame := readFrame(t, conn, &status); frame.Type != wsproto.TypeStatus || status.Status != "accepted" {
+			t.Errorf("first frame %+v, want the accepted status", frame)
+		}
+	})
+}
+
+// A typed query is answered with an accepted status, its tokens and one done
+// frame, all numbered in order under the query's request_id.
+func TestTypedQuery(t *testing.T) {
+	script := []string{"one", " two", " three"}
+	startFakeQueue(t, fakemodel.Config{Script: script})
+	conn := dialWS(t, newWSServer(t), "alice", "", wsproto.Subprotocol)
+
+	chatID, requestID := primitive.NewObjectID().Hex(), primitive.NewObjectID().Hex()
+	writeFrame(t, conn, wsproto.TypeQuery, requestID, map[string]any{"query": "count to three", "chatid": chatID})
+
+	var seq int64
+	check := func(frame wsproto.Frame) {
+		t.Helper()
+		if frame.RequestID != requestID {
+			t.Errorf("%s frame has request_id %q, want %s", frame.Type, frame.RequestID, requestID)
+		}
+		if seq++; frame.Seq != seq {
+			t.Errorf("%s frame has seq %d, want %d", frame.Type, frame.Seq, seq)
+		}
+	}
+
+	var status wsproto.Status
+	frame := readFrame(t, conn, &status)
+	check(frame)
+	if frame.Type != wsproto.TypeStatus || status.Status != "accepted" || status.ChatID != chatID {
+		t.Fatalf("got %s %+v, want the accepted status for chat %s", frame.Type, status, chatID)
+	}
+
+	var text strings.Builder
+	for {
+		frame = readFrame(t, conn, nil)
+		check(frame)
+		if frame.Type != wsproto.TypeToken {
+			break
+		}
+		var token wsproto.Token
+		if err := json.Unmarshal(frame.Payload, &token); err != nil {
+			t.Fatal(err)
+		}
+		text.WriteString(token.Text)
+	}
+	if got, want := text.String(), strings.Join(script, ""); got != want {
+		t.Errorf("tokens spell %q, want %q", got, want)
+	}
+
+	if frame.Type != wsproto.TypeDone {
+		t.Fatalf("answer ended with a %s frame %s", frame.Type, frame.Payload)
+	}
+	var done wsproto.Done
+	if err := json.Unmarshal(frame.Payload, &done); err != nil {
+		t.Fatal(err)
+	}
+	if done.FinishReason != "stop" || done.Usage.CompletionTokens != len(script) || done.Usage.PromptTokens != 3 {
+		t.Errorf("done %+v, want finish reason stop with %d completion and 3 prompt tokens", done, len(script))
+	}
+}
+
+// Refused frames are answered with one error frame carrying the code clients
+// act on and the request_id they sent.
+func TestTypedErrors(t *testing.T) {
+	chatID := primitive.NewObjectID().Hex()
+	tests := []struct {
+		name       string
+		typ        wsproto.Type
+		payload    any
+		overloaded bool // refuse every query
+		code       string
+	}{
+		{"unknown frame type", "bogus", nil, false, wsproto.CodeInvalidRequest},
+		{"temperature out of range", wsproto.TypeQuery, map[string]any{"query": "hi", "chatid": chatID, "temperature": 99}, false, wsproto.CodeInvalidRequest},
+		{"queue full", wsproto.TypeQuery, map[string]any{"query": "hi", "chatid": chatID}, true, wsproto.CodeOverloaded},
+		{"unknown resume", wsproto.TypeResume, nil, false, wsproto.CodeNotResumable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.overloaded {
+				defer func(prev int) { maxPendingPerUser = prev }(maxPendingPerUser)
+				maxPendingPerUser = 0
+			}
+			startFakeQueue(t, fakemodel.Config{})
+			conn := dialWS(t, newWSServer(t), "alice", "", wsproto.Subprotocol)
+
+			// Answers are kept for resuming under the user and request_id, so
+			// every case needs an id of its own.
+			requestID := primitive.NewObjectID().Hex()
+			writeFrame(t, conn, tt.typ, requestID, tt.payload)
+			var got wsproto.Error
+			frame := readFrame(t, conn, &got)
+			if frame.Type != wsproto.TypeError || got.Code != tt.code {
+				t.Fatalf("got %s %s, want a %s error", frame.Type, frame.Payload, tt.code)
+			}
+			if frame.RequestID != requestID {
+				t.Errorf("error has request_id %q, want %s", frame.RequestID, requestID)
+			}
+			if tt.overloaded && got.RetryAfter <= 0 {
+				t.Errorf("overloaded error without retry_after: %+v", got)
+			}
+		})
+	}
+}
+
+// A session refuses queries beyond wsMaxConcurrent and request_ids it is
+// still answering, and keeps answering the ones it has.
+func TestSessionAdmission(t *testing.T) {
+	defer func(prev int) { wsMaxConcurrent = prev }(wsMaxConcurrent)
+	wsMaxConcurrent = 1
+
+	startFakeQueue(t, fakemodel.Config{HangRate: 1})
+	conn := dialWS(t, newWSServer(t), "alice", "?session=1", wsproto.Subprotocol)
+	query := map[string]any{"query": "hang", "chatid": primitive.NewObjectID().Hex()}
+
+	first := primitive.NewObjectID().Hex()
+	writeFrame(t, conn, wsproto.TypeQuery, first, query)
+	if frame := readFrame(t, conn, nil); frame.Type != wsproto.TypeStatus {
+		t.Fatalf("got %s %s, want the accepted status", frame.Type, frame.Payload)
+	}
+
+	for _, tt := range []struct {
+		requestID, code string
+	}{
+		{first, wsproto.CodeInvalidRequest},
+		{primitive.NewObjectID().Hex(), wsproto.CodeBusy},
+	} {
+		writeFrame(t, conn, wsproto.TypeQuery, tt.requestID, query)
+		var got wsproto.Error
+		if frame := readFrame(t, conn, &got); frame.Type != wsproto.TypeError || got.Code != tt.code || frame.RequestID != tt.requestID {
+			t.Errorf("got %s %s for %s, want a %s error", frame.Type, frame.Payload, tt.requestID, tt.code)
+		}
+	}
+
+	writeFrame(t, conn, wsproto.TypeCancel, first, nil)
+	var got wsproto.Error
+	if frame := readFrame(t, conn, &got); got.Code != wsproto.CodeCancelled || frame.RequestID != first {
+		t.Errorf("got %s %s after cancelling, want the first query cancelled", frame.Type, frame.Payload)
+	}
+	// The session is done with the query once its answer has ended.
+	<-lookupStream("alice", first).done
+}
@@ -0,0 +1,130 @@
+// Package wsproto defines the typed WebSocket protocol of the Go server.
+//
+// A client that offers Subprotocol in Sec-WebSocket-Protocol gets every
+// message as a JSON Frame instead of bare token text, "[END]" and ad hoc error
+// objects. Clients that do not offer it keep the untyped protocol.
+//
+// The client sends a Frame of TypeQuery whose payload is the query object of
+// the untyped protocol ({"query": ..., "chatid": ..., sampling parameters}).
+// The server answers with TypeStatus and TypeToken frames and ends every
+// answer with exactly one TypeDone or TypeError frame.
+//
+// On a session connection the client may have several queries outstanding,
+// each under its own request_id. Their frames are interleaved, so clients
+// route them by request_id. A TypeCancel frame ends a query early with a
+// CodeCancelled error. A TypeStop frame ends it early as the user's stop
+// button does: with a TypeDone frame whose finish reason is FinishStopped, and
+// the part already sent is kept in the chat. Outside a session the request_id
+// of a TypeStop frame may be left out.
+//
+// An answer outlives its connection for a while. A client that lost the
+// connection sends a TypeResume frame with the request_id and, as seq, the
+// last seq it received, on a new connection of the same user; the frames it
+// missed are sent again and the answer continues from there, or it gets a
+// CodeNotResumable error if the answer is unknown or was kept too long. While
+// an answer can be resumed, a query reusing its request_id is refused with
+// CodeInvalidRequest.
+package wsproto
+
+import "encoding/json"
+
+// Subprotocol names this version of the protocol. An incompatible change gets
+// a new name, so old clients keep the version they know.
+const Subprotocol = "llmchat.v1"
+
+type Type string
+
+const (
+	// Client to server
+	TypeQuery  Type = "query"
+	TypeCancel Type = "cancel" // cancels the query with the frame's request_id
+	TypeResume Type = "resume" // resumes the answer with the frame's request_id after seq
+	TypeStop   Type = "stop"   // stops the answer with the frame's request_id, keeping it
+
+	// Server to client
+	TypeToken  Type = "token"
+	TypeStatus Type = "status"
+	TypeError  Type = "error"
+	TypeDone   Type = "done"
+)
+
+// Frame is every message of the protocol. Seq numbers the frames of one
+// request from 1 in the order the server sent them; clients only set it in
+// TypeResume frames.
+type Frame struct {
+	Type      Type            `json:"type"`
+	RequestID string          `json:"request_id,omitempty"`
+	Seq       int64           `json:"seq,omitempty"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+}
+
+// NewFrame builds a frame with payload encoded as JSON.
+func NewFrame(t Type, requestID string, payload any) (Frame, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return Frame{}, err
+	}
+	return Frame{Type: t, RequestID: requestID, Payload: data}, nil
+}
+
+// Token is the payload of a TypeToken frame.
+type Token struct {
+	Text string `json:"text"`
+}
+
+// Status is the payload of a TypeStatus frame. Status is one of
+//
+//	accepted     the query was read; ChatID is the chat it is added to
+//	queued       waiting for the model at Position, for about EtaMs
+//	dispatched   sent to the model
+//	first_token  the first token follows
+//	job_queued   stored as job JobID, see "async"
+//
+// Only accepted and job_queued are sent unless the query sets "status".
+type Status struct {
+	Status   string `json:"status"`
+	ChatID   string `json:"chatid,omitempty"`
+	Position int    `json:"position,omitempty"`
+	EtaMs    int64  `json:"eta_ms,omitempty"`
+	JobID    string `json:"job_id,omitempty"`
+}
+
+// Error codes of TypeError frames. Errors passed on from the model service
+// keep its codes.
+const (
+	CodeInvalidRequest = "invalid_request" // the query can never succeed as sent
+	CodeOverloaded     = "overloaded"      // try again after RetryAfter seconds
+	CodeBusy           = "busy"            // too many queries outstanding on the session
+	CodeExpired        = "expired"         // waited too long in the queue
+	CodeCancelled      = "cancelled"       // cancelled by the client or an administrator
+	CodeShuttingDown   = "shutting_down"   // the server is restarting; try again later
+	CodeTimeout        = "timeout"         // the model did not answer in time
+	CodeUnavailable    = "unavailable"     // the model service could not be reached
+	CodeInternal       = "internal"        // the server failed, e.g. to store the chat
+	CodeNotEnabled     = "not_enabled"     // the feature asked for is switched off
+	CodeNotResumable   = "not_resumable"   // no answer to resume under that request_id
+)
+
+// Error is the payload of a TypeError frame.
+type Error struct {
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	RetryAfter int    `json:"retry_after,omitempty"` // seconds, with CodeOverloaded
+}
+
+// Usage counts the tokens of a completed answer.
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+}
+
+// FinishStopped is the finish reason of an answer stopped by a TypeStop frame.
+const FinishStopped = "stopped by user"
+
+// Done is the payload of a TypeDone frame, sent once an answer is complete.
+type Done struct {
+	FinishReason string `json:"finish_reason"`
+	Usage        Usage  `json:"usage"`
+	LatencyMs    int64  `json:"latency_ms,omitempty"`
+	Cached       bool   `json:"cached,omitempty"` // answered from the response cache
+}
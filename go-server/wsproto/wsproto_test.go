@@ -0,0 +1,41 @@
+package wsproto
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	frame, err := NewFrame(TypeError, "r1", Error{Code: CodeOverloaded, Message: "busy", RetryAfter: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame.Seq = 7
+
+	data, err := json.Marshal(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"type":"error","request_id":"r1","seq":7,"payload":{"code":"overloaded","message":"busy","retry_after":3}}`
+	if string(data) != want {
+		t.Errorf("encoded %s, want %s", data, want)
+	}
+
+	var decoded Frame
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	var payload Error
+	if err := json.Unmarshal(decoded.Payload, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Type != TypeError || decoded.RequestID != "r1" || decoded.Seq != 7 || payload.RetryAfter != 3 {
+		t.Errorf("decoded %+v with payload %+v", decoded, payload)
+	}
+}
+
+func TestNewFrameError(t *testing.T) {
+	if _, err := NewFrame(TypeToken, "r1", func() {}); err == nil {
+		t.Error("NewFrame encoded a func payload")
+	}
+}
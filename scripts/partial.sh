@@ -8,7 +8,7 @@ set -e
 #####################################
 echo "Starting Go server..."
 cd ./go-server
-go run *.go &
+go run . &
 GO_SERVER_PID=$!
 echo "Go server started with PID: $GO_SERVER_PID"
 
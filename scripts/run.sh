@@ -21,7 +21,7 @@ sleep 60
 #####################################
 echo "Starting Go server..."
 cd ..
-go run *.go &
+go run . &
 GO_SERVER_PID=$!
 echo "Go server started with PID: $GO_SERVER_PID"
 